@@ -49,6 +49,7 @@ func main() {
 			continue
 		}
 		client.Call("DemoService.WhoAmI", true, &res)
+		client.Close()
 		log.Printf("for runas user %s, got: %#v", user, res)
 	}
 }
@@ -0,0 +1,70 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AuditEvent records one attempt by a child to drop privileges.
+type AuditEvent struct {
+	Time time.Time
+
+	// Child is whether the event was reported by the child itself,
+	// as it dropped privileges, rather than by its parent.
+	Child bool
+
+	ParentUid int // the uid the child started as
+	Pid       int // the child's
+
+	Uid, Gid int    // what the child was dropping to
+	Groups   []int  // its supplementary groups
+	Username string // the user's name, if known
+
+	// EffectiveOnly is whether the drop was only of the effective
+	// ids, so the child can become root again; see
+	// Config.EffectiveOnly.
+	EffectiveOnly bool
+
+	// Err is why the drop failed, or nil if it succeeded.
+	Err error
+}
+
+var auditor atomic.Pointer[func(AuditEvent)]
+
+// SetAuditor makes fn be called with an AuditEvent every time a
+// child drops privileges or fails to, in the parent once it knows the
+// outcome and, if the child also calls SetAuditor before
+// MaybeRunChildServer, in the child once it's done. The child calls
+// fn as the user it dropped to, after any seccomp filter is
+// installed, and before replying to the parent. A nil fn restores
+// the default, which does nothing.
+func SetAuditor(fn func(AuditEvent)) {
+	if fn == nil {
+		auditor.Store(nil)
+		return
+	}
+	auditor.Store(&fn)
+}
+
+func audit(ev AuditEvent) {
+	if fn := auditor.Load(); fn != nil {
+		ev.Time = time.Now()
+		(*fn)(ev)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// capNumbers is from <linux/capability.h>.
+var capNumbers = map[string]int{
+	"CAP_CHOWN":              0,
+	"CAP_DAC_OVERRIDE":       1,
+	"CAP_DAC_READ_SEARCH":    2,
+	"CAP_FOWNER":             3,
+	"CAP_FSETID":             4,
+	"CAP_KILL":               5,
+	"CAP_SETGID":             6,
+	"CAP_SETUID":             7,
+	"CAP_SETPCAP":            8,
+	"CAP_LINUX_IMMUTABLE":    9,
+	"CAP_NET_BIND_SERVICE":   10,
+	"CAP_NET_BROADCAST":      11,
+	"CAP_NET_ADMIN":          12,
+	"CAP_NET_RAW":            13,
+	"CAP_IPC_LOCK":           14,
+	"CAP_IPC_OWNER":          15,
+	"CAP_SYS_MODULE":         16,
+	"CAP_SYS_RAWIO":          17,
+	"CAP_SYS_CHROOT":         18,
+	"CAP_SYS_PTRACE":         19,
+	"CAP_SYS_PACCT":          20,
+	"CAP_SYS_ADMIN":          21,
+	"CAP_SYS_BOOT":           22,
+	"CAP_SYS_NICE":           23,
+	"CAP_SYS_RESOURCE":       24,
+	"CAP_SYS_TIME":           25,
+	"CAP_SYS_TTY_CONFIG":     26,
+	"CAP_MKNOD":              27,
+	"CAP_LEASE":              28,
+	"CAP_AUDIT_WRITE":        29,
+	"CAP_AUDIT_CONTROL":      30,
+	"CAP_SETFCAP":            31,
+	"CAP_MAC_OVERRIDE":       32,
+	"CAP_MAC_ADMIN":          33,
+	"CAP_SYSLOG":             34,
+	"CAP_WAKE_ALARM":         35,
+	"CAP_BLOCK_SUSPEND":      36,
+	"CAP_AUDIT_READ":         37,
+	"CAP_PERFMON":            38,
+	"CAP_BPF":                39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+const (
+	capSetgid = 6 // CAP_SETGID
+	capSetuid = 7 // CAP_SETUID
+)
+
+// parseCaps returns the numbers of the named capabilities.
+func parseCaps(names []string) ([]int, error) {
+	var caps []int
+	for _, name := range names {
+		n, ok := capNumbers[name]
+		if !ok {
+			return nil, fmt.Errorf("runas: unknown capability %q", name)
+		}
+		caps = append(caps, n)
+	}
+	return caps, nil
+}
+
+const (
+	prSetKeepcaps       = 8
+	linuxCapabilityVer3 = 0x20080522
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective, permitted, inheritable uint32
+}
+
+// errCapsCgo is why a binary that uses cgo can't keep capabilities.
+// Keepcaps and the capability sets are per-thread, a thread can only
+// change its own, and only without cgo can the runtime have every
+// thread change them.
+var errCapsCgo = errors.New("capabilities need a binary built without cgo, as with CGO_ENABLED=0 or the osusergo and netgo build tags")
+
+// checkCaps fails with errCapsCgo if the process can't keep
+// capabilities, so that the parent, when it's the same binary as the
+// child, doesn't start a child that's bound to fail.
+func checkCaps() error {
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_GETPID, 0, 0, 0); errno == syscall.ENOTSUP {
+		return errCapsCgo
+	}
+	return nil
+}
+
+// setKeepCaps sets or clears keepcaps on every thread, which
+// decides whether the permitted capabilities survive setuid.
+func setKeepCaps(keep bool) error {
+	var v uintptr
+	if keep {
+		v = 1
+	}
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepcaps, v, 0)
+	if errno == syscall.ENOTSUP {
+		return errCapsCgo
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// limitCaps makes caps the only permitted and effective capabilities
+// of every thread, and checks that they took.
+func limitCaps(caps []int) error {
+	var data [2]capData
+	for _, c := range caps {
+		data[c/32].permitted |= 1 << (c % 32)
+	}
+	data[0].effective = data[0].permitted
+	data[1].effective = data[1].permitted
+	hdr := capHeader{version: linuxCapabilityVer3}
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno == syscall.ENOTSUP {
+		return errCapsCgo
+	}
+	if errno != 0 {
+		return errno
+	}
+
+	var got [2]capData
+	hdr = capHeader{version: linuxCapabilityVer3}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&got[0])), 0); errno != 0 {
+		return errno
+	}
+	for _, c := range caps {
+		if got[c/32].effective&(1<<(c%32)) == 0 {
+			return fmt.Errorf("capability %d missing after capset", c)
+		}
+	}
+	return nil
+}
+
+// prGetSeccomp is from <linux/prctl.h>.
+const prGetSeccomp = 21
+
+// probeSandbox reports the process's effective capabilities, if it
+// can tell, and its seccomp mode: 0 for none, 2 for a filter. It
+// uses no files, since it may run anywhere.
+func probeSandbox() (caps uint64, capsKnown bool, seccompMode int) {
+	var got [2]capData
+	hdr := capHeader{version: linuxCapabilityVer3}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&got[0])), 0); errno == 0 {
+		caps = uint64(got[1].effective)<<32 | uint64(got[0].effective)
+		capsKnown = true
+	}
+	seccompMode = -1
+	if mode, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prGetSeccomp, 0, 0); errno == 0 {
+		seccompMode = int(mode)
+	}
+	return caps, capsKnown, seccompMode
+}
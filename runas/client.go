@@ -0,0 +1,512 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client is an rpc Client connected to Server running in a child
+// process as another user.
+type Client struct {
+	*rpc.Client // nil until the handshake is done
+	cmd         *exec.Cmd
+	obs         Observer
+	log         *slog.Logger
+	conn        io.ReadWriteCloser
+	codec       *countingCodec
+
+	codecKind Codec
+	transport string // the name of the Transport conn came from
+	uid, gid  int
+	started   time.Time
+
+	killGroup  bool    // whether to kill the child's process group; see Config.Setpgid
+	rlimitErrs []error // see RlimitErrors
+	mechanism  string  // see Mechanism
+
+	closing atomic.Bool   // set once Close starts
+	exited  chan struct{} // closed once cmd.Wait returns
+	waitErr error         // cmd.Wait's result; valid once exited is closed
+}
+
+// newClient returns a Client for the just-started cmd, connected
+// over conn from the named transport, as configured by conf, and starts reaping cmd in the
+// background. Calls can't be made until startRPC.
+func newClient(cmd *exec.Cmd, conf *Config, transport string, conn io.ReadWriteCloser, uid, gid int) *Client {
+	c := &Client{
+		cmd:    cmd,
+		obs:    getObserver(),
+		log:    conf.logger(),
+		conn:   conn,
+		exited: make(chan struct{}),
+
+		codecKind: conf.Codec,
+		transport: transport,
+		uid:       uid,
+		gid:       gid,
+		started:   time.Now(),
+		killGroup: conf.Setpgid,
+	}
+	if len(conf.ForwardSignals) > 0 {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, conf.ForwardSignals...)
+		go c.forwardSignals(sigc)
+	}
+	trackClient(c)
+	go func() {
+		c.killGroupOnExit()
+		c.waitErr = cmd.Wait()
+		if errors.Is(c.waitErr, exec.ErrWaitDelay) {
+			// The child exited cleanly; something it left
+			// behind still has its stderr.
+			c.waitErr = nil
+		}
+		untrackClient(c)
+		releaseChild()
+		close(c.exited)
+		c.log.Debug("runas: child exited", "pid", cmd.Process.Pid, "status", cmd.ProcessState)
+		c.obs.OnChildExit(cmd.Process.Pid, cmd.ProcessState)
+	}()
+	return c
+}
+
+// startRPC starts c's rpc client on its connection, once the
+// handshake is done with it.
+func (c *Client) startRPC() {
+	c.codec = &countingCodec{ClientCodec: c.codecKind.clientCodec(c.conn), eof: make(chan struct{})}
+	c.Client = rpc.NewClientWithCodec(c.codec)
+}
+
+// startRelay, in place of startRPC, relays between ext and the
+// child for Config.Conn, leaving c to stop the child but not to
+// make calls.
+func (c *Client) startRelay(ext io.ReadWriteCloser) {
+	rc := &relayCodec{conn: c.conn, ext: ext, done: make(chan struct{})}
+	c.codec = &countingCodec{ClientCodec: rc, eof: make(chan struct{})}
+	c.Client = rpc.NewClientWithCodec(c.codec)
+	go func() {
+		// Calls, until the other end stops sending; then the child
+		// finishes them and exits, as after Shutdown.
+		io.Copy(c.conn, ext)
+		if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			c.conn.Close()
+		}
+	}()
+	go func() {
+		// Replies, until the child closes its side.
+		io.Copy(ext, c.conn)
+		ext.Close()
+		close(rc.done)
+	}()
+}
+
+// errRelayed is the error from calls on a Client whose child is
+// called over Config.Conn.
+var errRelayed = errors.New("runas: child is called over Config.Conn, not its Client")
+
+// relayCodec is the ClientCodec of a Client started by startRelay.
+// It makes no calls, and reads nothing until the relay is done.
+type relayCodec struct {
+	conn, ext io.ReadWriteCloser
+	done      chan struct{} // closed once the child's replies stop
+}
+
+func (rc *relayCodec) WriteRequest(*rpc.Request, any) error {
+	return errRelayed
+}
+
+func (rc *relayCodec) ReadResponseHeader(*rpc.Response) error {
+	<-rc.done
+	return io.EOF
+}
+
+func (rc *relayCodec) ReadResponseBody(any) error {
+	return nil
+}
+
+func (rc *relayCodec) Close() error {
+	err := rc.conn.Close()
+	rc.ext.Close()
+	return err
+}
+
+// forwardSignals relays signals from sigc to the child until it
+// exits.
+func (c *Client) forwardSignals(sigc chan os.Signal) {
+	defer signal.Stop(sigc)
+	for {
+		select {
+		case sig := <-sigc:
+			c.cmd.Process.Signal(sig)
+		case <-c.exited:
+			return
+		}
+	}
+}
+
+// Pid returns the process id of the child.
+func (c *Client) Pid() int {
+	return c.cmd.Process.Pid
+}
+
+// Uid returns the user id the child dropped to.
+func (c *Client) Uid() int {
+	return c.uid
+}
+
+// Gid returns the group id the child dropped to.
+func (c *Client) Gid() int {
+	return c.gid
+}
+
+// Codec returns the encoding used on c's connection.
+func (c *Client) Codec() Codec {
+	return c.codecKind
+}
+
+// Socket reports whether c is connected to its child over a
+// socketpair, as asked for with Config.Socket, rather than the
+// child's stdin and stdout.
+func (c *Client) Socket() bool {
+	return c.transport == SocketTransport || c.transport == TLSTransport
+}
+
+// Transport returns the name of the transport c is connected to its
+// child with; see Config.Transport.
+func (c *Client) Transport() string {
+	return c.transport
+}
+
+// String describes c for debugging, as in
+// "runas child 1234 (uid 1001, gid 1001; gob over pipes)".
+func (c *Client) String() string {
+	transport := c.transport
+	switch transport {
+	case PipeTransport:
+		transport = "pipes"
+	case SocketTransport, TLSTransport:
+		transport = "socketpair"
+	}
+	return fmt.Sprintf("runas child %d (uid %d, gid %d; %v over %s)", c.Pid(), c.uid, c.gid, c.codecKind, transport)
+}
+
+// AllowedMethods asks the child which methods it's restricted to,
+// as set by Config.AllowMethods, returning nil if it serves them
+// all.
+func (c *Client) AllowedMethods() ([]string, error) {
+	var names []string
+	err := c.Call("InternalGoRunAs.AllowedMethods", true, &names)
+	return names, err
+}
+
+// Mechanism names the syscalls the child dropped privileges with:
+// "setresuid" where there is one, as on Linux, which drops the
+// saved ids too, "setuid" elsewhere, or "seteuid" with
+// Config.EffectiveOnly.
+func (c *Client) Mechanism() string {
+	return c.mechanism
+}
+
+// RlimitErrors returns, for each of Config.Rlimits in order, the
+// error the child got setting it, or nil if it was set. Limits
+// marked Required never have an error here, since the child
+// wouldn't have started.
+func (c *Client) RlimitErrors() []error {
+	return c.rlimitErrs
+}
+
+// Wait waits for the child to exit and reports how, as cmd.Wait
+// would: the error is nil only if it exited with status 0. It
+// doesn't make the child exit; see Close. Wait may be called any
+// number of times, concurrently, and always returns the same result.
+func (c *Client) Wait() (*os.ProcessState, error) {
+	<-c.exited
+	return c.cmd.ProcessState, c.waitErr
+}
+
+// CallContext is like Call, but if ctx is done before the call
+// completes, it closes c, killing the child, and returns ctx.Err().
+// net/rpc can't cancel a single call, so this is the only way to
+// stop a method that's taking too long.
+func (c *Client) CallContext(ctx context.Context, serviceMethod string, args any, reply any) error {
+	select {
+	case call := <-c.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1)).Done:
+		return call.Error
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
+
+// Ping checks that the child behind c is still answering calls,
+// with a round trip through the same connection and codec as any
+// other call.
+func Ping(c *Client) error {
+	return c.ping(context.Background())
+}
+
+func (c *Client) ping(ctx context.Context) error {
+	var pong bool
+	return c.CallContext(ctx, "InternalGoRunAs.Ping", true, &pong)
+}
+
+// alive reports whether the child is still running, c hasn't been
+// closed, and its connection hasn't broken.
+func (c *Client) alive() bool {
+	if c.closing.Load() {
+		return false
+	}
+	var eof <-chan struct{}
+	if c.codec != nil {
+		eof = c.codec.eof
+	}
+	select {
+	case <-c.exited:
+		return false
+	case <-eof:
+		return false
+	default:
+		return true
+	}
+}
+
+// ErrDraining is the error from calls started on a Client after
+// Drain.
+var ErrDraining = errors.New("runas: client is draining")
+
+// Drain shuts c down gracefully: new calls fail with ErrDraining,
+// and once the calls in flight have finished, Drain closes c, as
+// Close does. If ctx is done first, Drain closes c anyway,
+// interrupting the calls left, and returns ctx.Err().
+func (c *Client) Drain(ctx context.Context) error {
+	select {
+	case <-c.codec.drain():
+	case <-c.exited:
+		// Nothing more is coming.
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+	return c.Close()
+}
+
+// Close closes the connection to the child process, kills the
+// child, or with Config.Setpgid its whole process group, and waits
+// for it to exit. Once Close returns, the child is gone. See
+// Shutdown for letting it exit on its own.
+func (c *Client) Close() error {
+	c.closing.Store(true)
+	var err error
+	if c.Client != nil {
+		err = c.Client.Close()
+	} else {
+		err = c.conn.Close()
+	}
+	c.kill()
+	<-c.exited
+	return err
+}
+
+// Shutdown closes c gently: it refuses new calls and closes the
+// connection's write side only, so that the child, once it has read
+// the calls already sent, finishes them, replies, and exits with
+// status 0, giving deferred cleanup in a child started with
+// ServeChild a chance to run. The calls' replies still reach their
+// callers. If the child hasn't exited by the time ctx is done,
+// Shutdown kills it, as Close does, and returns ctx.Err();
+// otherwise it returns how the child exited, as Wait does. Either
+// way, once Shutdown returns the child is gone, and with
+// Config.Setpgid, on Linux, the rest of its process group too.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.closing.Store(true)
+	if !c.codec.closeWrite(c.conn) {
+		// There's no closing just one side, so calls in flight
+		// may not get their replies.
+		c.Client.Close()
+	}
+	// The child closes its side when it exits, so once the replies
+	// are all read, it's done.
+	done := make(chan struct{})
+	go func() {
+		<-c.codec.eof
+		<-c.exited
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.kill()
+		c.Client.Close()
+		<-c.exited
+		return ctx.Err()
+	}
+	c.Client.Close()
+	return c.waitErr
+}
+
+// countingCodec counts the calls in flight on a ClientCodec, and
+// refuses new ones once draining.
+type countingCodec struct {
+	rpc.ClientCodec
+
+	wmu sync.Mutex // held while writing a request
+
+	mu       sync.Mutex
+	inflight int
+	idle     chan struct{} // non-nil once draining; closed when inflight is zero
+
+	eof     chan struct{} // closed once reading responses has stopped
+	eofOnce sync.Once
+}
+
+func (cc *countingCodec) WriteRequest(r *rpc.Request, body any) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cc.mu.Lock()
+	if cc.idle != nil {
+		cc.mu.Unlock()
+		return ErrDraining
+	}
+	cc.inflight++
+	cc.mu.Unlock()
+	err := cc.ClientCodec.WriteRequest(r, body)
+	if err != nil {
+		// The call fails without a response.
+		cc.finished()
+	}
+	return err
+}
+
+func (cc *countingCodec) ReadResponseHeader(r *rpc.Response) error {
+	err := cc.ClientCodec.ReadResponseHeader(r)
+	if err != nil {
+		// net/rpc stops reading, and fails the calls left.
+		cc.eofOnce.Do(func() { close(cc.eof) })
+	}
+	return err
+}
+
+func (cc *countingCodec) ReadResponseBody(body any) error {
+	err := cc.ClientCodec.ReadResponseBody(body)
+	cc.finished()
+	return err
+}
+
+func (cc *countingCodec) finished() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.inflight--
+	if cc.inflight == 0 && cc.idle != nil {
+		close(cc.idle)
+	}
+}
+
+// closeWrite refuses new calls and, once any request being written
+// is done, closes the write side of conn, the connection cc runs
+// over, if it can be closed alone. It reports whether it could.
+func (cc *countingCodec) closeWrite(conn io.ReadWriteCloser) bool {
+	cc.drain()
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return false
+	}
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cw.CloseWrite()
+	return true
+}
+
+// drain refuses new calls and returns a channel that's closed once
+// there are none in flight.
+func (cc *countingCodec) drain() <-chan struct{} {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.idle == nil {
+		cc.idle = make(chan struct{})
+		if cc.inflight == 0 {
+			close(cc.idle)
+		}
+	}
+	return cc.idle
+}
+
+// gobClientCodec is net/rpc's unexported gob ClientCodec, as used by
+// rpc.NewClient.
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobClientCodec(conn io.ReadWriteCloser) *gobClientCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobClientCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body any) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		return gobTypeHint(err)
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body any) error {
+	return gobTypeHint(c.dec.Decode(body))
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// gobTypeHint points out RegisterType in gob's errors for types sent
+// as interfaces without being registered.
+func gobTypeHint(err error) error {
+	if err != nil && strings.Contains(err.Error(), "not registered for interface") {
+		return fmt.Errorf("%w (see runas.RegisterType)", err)
+	}
+	return err
+}
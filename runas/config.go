@@ -0,0 +1,812 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Config controls how child processes are started. The zero value
+// starts children the same way as the package-level functions.
+type Config struct {
+	// ChildBinary is the program to run as the child. It must
+	// register the same services and call MaybeRunChildServer. If
+	// empty, the running binary is used: on Linux, as found through
+	// /proc/self/exe, which works even if the file has since been
+	// replaced, as by a deploy, and elsewhere os.Args[0], as
+	// resolved when MaybeRunChildServer was called.
+	ChildBinary string
+
+	// ChildArgv0, if non-empty, is the child's argv[0], separately
+	// from the binary run. By default it's os.Args[0], or
+	// ChildBinary if that's set. SELinux and AppArmor decide domain
+	// and profile transitions by the executable file, not argv[0],
+	// so this can't change which one the child gets; that takes a
+	// ChildBinary that policy labels or names, such as a hard link
+	// or copy. It still matters to policies and tools that match
+	// command lines, such as pkill -f and audit rules on execve
+	// arguments.
+	ChildArgv0 string
+
+	// ChildArgs are arguments to give the child after argv[0], for
+	// programs whose flag parsing or other startup looks at them.
+	// The child is still recognized by its environment, not its
+	// arguments. Everything the child runs before it drops
+	// privileges, such as init functions, runs as root and can see
+	// them, so they must be trusted.
+	ChildArgs []string
+
+	// ChildConfig, if non-nil, is passed to the child, which gets
+	// it with the package-level ChildConfig, so that it can
+	// configure itself without reading config files as the user it
+	// runs as. It's opaque to the package; encode it as you like,
+	// such as with JSON. It travels in the handshake, so it's held
+	// in memory at both ends and must be under the handshake's
+	// limit of 64MB; a few megabytes at most is sensible.
+	ChildConfig []byte
+
+	// Server, if non-nil, is the server the child runs instead of
+	// the package's Server. It must have been created by NewServer.
+	Server *rpc.Server
+
+	// Chroot, if non-empty, is a directory the child chroots into
+	// before dropping privileges. The parent looks up users and
+	// groups, so it needn't contain /etc/passwd or /etc/group, or
+	// anything else.
+	Chroot string
+
+	// Setup, if non-empty, names a function registered with
+	// RegisterSetup that the child calls while still root, before
+	// chrooting and dropping privileges, for setup that has to
+	// happen in the child itself. Anything it opens stays open
+	// after the drop. If it fails, so does the child.
+	//
+	// It may do part of its work as an intermediate user, but it
+	// must be root again when it returns, since the drop that
+	// follows needs root. On Linux, that means keeping root as the
+	// saved uid, with syscall.Setresuid(uid, uid, 0) and then
+	// syscall.Setresuid(0, 0, 0) to switch back; a setup step
+	// that gives up root for good makes the drop fail, and the
+	// child with it. Capabilities are only limited after it
+	// returns. The final drop replaces the real, effective and
+	// saved ids, so nothing the setup step did to them survives.
+	Setup string
+
+	// WorkingDir is the child's working directory. If empty, it's
+	// "/". The child changes to it after chrooting and dropping
+	// privileges, so it's relative to Chroot, and the child fails
+	// to start if the user it runs as can't access it.
+	WorkingDir string
+
+	// ExtraEnv lists environment variables to set in the child,
+	// which otherwise starts with an empty environment. Each entry
+	// is either "KEY=value", or a bare "KEY" to copy KEY from the
+	// parent's environment if it's set there.
+	ExtraEnv []string
+
+	// ScrubEnv, if non-nil, makes the child inherit the parent's
+	// environment, less any variable whose name matches one of its
+	// path.Match patterns, such as "*SECRET*" or "*TOKEN*". An empty
+	// non-nil list inherits everything. The user's HOME, USER,
+	// LOGNAME and SHELL still replace the parent's unless MinimalEnv
+	// is set, and ExtraEnv is applied last: a variable it names is
+	// passed even if it matches a pattern, since naming it is
+	// explicit.
+	ScrubEnv []string
+
+	// MinimalEnv, if true, stops HOME, USER, LOGNAME and SHELL from
+	// being set in the child for the user it runs as. SHELL is the
+	// user's login shell, or /bin/sh if their passwd entry has none.
+	MinimalEnv bool
+
+	// LocaleEnv, if true, copies the parent's TZ, LANG and LC_*
+	// variables, such as LC_ALL and LC_TIME, into the child, for
+	// children that format times or messages for people. Like
+	// ExtraEnv, it applies even to variables ScrubEnv matches.
+	LocaleEnv bool
+
+	// InitGroups, if true, makes UidGid give the child the
+	// supplementary groups of uid's passwd entry, plus gid, as
+	// initgroups(3) would; it's an error if uid has none. By default
+	// a child started by UidGid has gid as its only group, so that it
+	// doesn't keep root's. User, Uid and UserGroup always set the
+	// user's groups.
+	InitGroups bool
+
+	// Umask, if non-nil, is the umask the child sets after dropping
+	// privileges. Otherwise the child inherits the parent's.
+	Umask *int
+
+	// Rlimits are resource limits the child sets, in order, after
+	// dropping privileges. Since the child is no longer root, it
+	// can only lower limits. If a Required one can't be set, the
+	// child is killed and the error says which; other failures are
+	// reported by Client.RlimitErrors.
+	Rlimits []Rlimit
+
+	// OomScoreAdj, if non-nil, is written to the child's
+	// oom_score_adj, from -1000 to 1000, while it's still root, so
+	// that the kernel's OOM killer prefers it (positive) or spares
+	// it (negative) relative to the parent. The child fails to
+	// start if it can't be set. It's Linux-only and ignored
+	// elsewhere.
+	OomScoreAdj *int
+
+	// CPUAffinity, if non-empty, lists the CPUs, numbered from 0 as
+	// in /proc/cpuinfo, that the child's threads may run on, as set
+	// with sched_setaffinity(2) before it drops privileges. The
+	// child fails to start if it can't be set, as when none of the
+	// CPUs is online or allowed by the child's cpuset. It's a
+	// placement hint, not a restriction: the child can change its
+	// own affinity later, which only a cgroup's cpuset prevents.
+	// It's Linux-only and ignored elsewhere.
+	CPUAffinity []int
+
+	// Nice, if non-nil, is the child's nice value, from -20 (most
+	// favored) to 19 (least), set with setpriority(2) while it's
+	// still root, so that it can be raised as well as lowered. The
+	// child checks that it took, and fails to start if not. A
+	// positive value keeps background children from starving the
+	// parent.
+	Nice *int
+
+	// DisableCoreDumps, if true, has the child set its RLIMIT_CORE
+	// to zero after dropping privileges, and on Linux also mark
+	// itself not dumpable, which keeps other processes of the same
+	// user from attaching to it with ptrace, so that secrets it
+	// handles can't end up in a core file. The child fails to start
+	// if either can't be done.
+	DisableCoreDumps bool
+
+	// NoNewPrivs, if true, has the child set no_new_privs after
+	// dropping privileges, so it can't gain any by executing a
+	// setuid binary. The child fails to start if it can't be set.
+	// In binaries built with cgo, the only way to set it on every
+	// thread is with a seccomp filter, so the child also gets one
+	// that allows everything. It's Linux-only and ignored
+	// elsewhere.
+	NoNewPrivs bool
+
+	// SeccompFilter, if non-empty, names a filter registered with
+	// RegisterSeccompFilter that the child installs as the last
+	// step of dropping privileges, after setting no_new_privs. The
+	// filter must allow everything the child goes on to do,
+	// starting with writing its reply to the parent. It's
+	// Linux-only, and elsewhere the child fails to start.
+	SeccompFilter string
+
+	// Capabilities names Linux capabilities, such as
+	// "CAP_NET_BIND_SERVICE", that the child keeps after dropping
+	// to a non-root uid; it loses all others. The child checks
+	// that they're in effect, and fails to start if not. Keeping
+	// CAP_SETUID defeats the check that the child can't regain
+	// root, so that check is skipped. Capabilities are per-thread
+	// state that only the runtime can change on every thread, and
+	// it can't in binaries built with cgo, which by default
+	// includes any that use os/user or net, as this package does:
+	// build with CGO_ENABLED=0, or the osusergo and netgo build
+	// tags, or the child fails to start. It's Linux-only, and
+	// elsewhere the child fails to start.
+	Capabilities []string
+
+	// EffectiveOnly, if true, makes the drop temporary: the child
+	// changes only its effective gid and uid, with setegid(2) and
+	// seteuid(2), and keeps root as its real and saved ids, so that
+	// it can become root again with syscall.Seteuid(0). That's for
+	// checks made as the user, such as whether it can open a file,
+	// by a child that then needs root back. Note that access(2)
+	// goes by the real uid, which is still root; use faccessat(2)
+	// with AT_EACCESS instead. This is much weaker than the normal
+	// drop, which can't be undone: anything that gets to run code
+	// in the child can become root, so it protects against
+	// mistakes, not attacks. The groups are set as usual, and the
+	// check that the child can't regain root is skipped. It can't
+	// be combined with Capabilities.
+	EffectiveOnly bool
+
+	// ProcessName, if non-empty, is a name for the child to show
+	// in ps and top, with any "%s" replaced by the name (or, if
+	// unknown, the uid) of the user it runs as; for example
+	// "runas[%s]". Linux truncates it to 15 bytes. It's ignored
+	// on other systems.
+	ProcessName string
+
+	// ForwardSignals lists signals that, when the parent gets
+	// them, are relayed to the child until it exits. By default
+	// none are. As with signal.Notify, which this uses, a parent
+	// that forwards a signal no longer gets that signal's default
+	// action, such as exiting on SIGINT, so it should handle the
+	// signal itself.
+	ForwardSignals []os.Signal
+
+	// UserNamespace, if true, starts the child in a new user
+	// namespace, Linux only, with UidMappings and GidMappings as its
+	// id maps. The ids the child drops to are then ones inside the
+	// namespace. The maps must map the parent's own uid to 0, so
+	// that the child starts as root inside and can drop from there.
+	// A parent that isn't root can map only its own uid and gid,
+	// and then the kernel forbids setgroups in the child, which
+	// keeps whatever groups it had. This lets a parent that isn't
+	// root use the package, with 0 as the child's only uid to drop
+	// to.
+	UserNamespace bool
+	UidMappings   []IDMap
+	GidMappings   []IDMap
+
+	// MountNamespace, if true, starts the child in a new mount
+	// namespace, Linux only, so that the mounts it sees are its
+	// own; it needs root, or UserNamespace. Before its Setup step,
+	// the child marks every mount private, so that nothing it
+	// mounts or unmounts propagates back to the parent. Setup, as
+	// root and before any chroot, is then the place for bind
+	// mounts or pivot_root(2). Pick one way to confine the child:
+	// either Setup bind-mounts what the child needs under a
+	// directory that Chroot names, or Setup pivots into the new
+	// root itself and Chroot is left empty, since it would then be
+	// relative to that. Unlike chroot, pivot_root followed by
+	// unmounting the old root leaves nothing to escape back to.
+	MountNamespace bool
+
+	// ReadOnlyRoot, if true, has the child remount its root
+	// read-only after its Setup step and before it drops
+	// privileges, so that it can't modify the filesystem whatever
+	// the permissions say. The root is Chroot if that's set, which
+	// is first bind-mounted onto itself so that it's a mount point
+	// of its own. Only the root mount itself is made read-only:
+	// mounts under it, such as ones Setup bind-mounts in for what
+	// the child does need to write, stay as they are, and making
+	// those is up to the caller. It needs MountNamespace, so that
+	// the parent's mounts are unaffected.
+	ReadOnlyRoot bool
+
+	// Setsid, if true, starts the child in a new session, so it
+	// doesn't get signals sent to the parent's process group or
+	// terminal.
+	Setsid bool
+
+	// Detach, if true, makes the child a daemon that no terminal
+	// can stop: it starts in a new session, as with Setsid, so it
+	// has no controlling terminal, and its stdin is never a
+	// terminal, which only matters with Socket, since otherwise
+	// stdin is the connection to the parent. A terminal (or other
+	// character device) that PrepareCmd sets as Stdin is replaced
+	// with the null device. (SysProcAttr.Noctty isn't used: it
+	// fails unless stdin is the controlling terminal.) A detached
+	// child still doesn't outlive its parent: on Linux the kernel
+	// kills it with SIGKILL if the parent dies.
+	Detach bool
+
+	// Conn, if non-nil, is where the child's calls come from once
+	// it has dropped privileges: a connection, such as one accepted
+	// from a network listener, whose other end calls the child with
+	// Codec, as the parent would. The parent relays between Conn and
+	// its connection to the child, so that a service running as
+	// another user can be proxied to another machine. The Client
+	// still stops the child, and closes Conn when it does, but can't
+	// make calls itself. The child exits once the other end stops
+	// sending. Of the package's own methods, only Ping, Ready and
+	// AllowedMethods of InternalServiceName are served over Conn,
+	// unless ConnInternal is set. ReadyTimeout can't be used with
+	// Conn; the other end can call Ready itself.
+	Conn io.ReadWriteCloser
+
+	// ConnInternal, if true, serves all of the package's own
+	// methods, such as AddService and RunTask, over Conn.
+	ConnInternal bool
+
+	// Setpgid, if true, puts the child in a new process group of
+	// its own, as Setsid also does, and kills the rest of the group
+	// when the child exits, however it exits, as when Client.Close
+	// kills it, taking any processes the child started with it. On
+	// Linux that's done before the child is reaped, while the
+	// group's id can't yet belong to anyone else. Other systems
+	// have no waiting without reaping, so there only Close and
+	// Drain kill the group, and only if the child hasn't yet exited.
+	Setpgid bool
+
+	// Files are open files to pass to the child, which it can get
+	// with InheritedFiles, in the same order. This is how a child
+	// that can't open something itself, such as a socket listening
+	// on a low port, gets to use it: the parent opens it first.
+	Files []*os.File
+
+	// Hardened, if true, starts the child from a known-minimal
+	// state, as far as the system allows. The child is started as
+	// if Setsid were set, which also detaches it from any
+	// controlling terminal, and with only stdin, stdout, stderr and
+	// Files open: the child fails to start if PrepareCmd changes
+	// ExtraFiles, and on Linux, if the parent has any other
+	// descriptor open without close-on-exec (descriptors opened by
+	// package os always have it; ones from cgo or inherited by the
+	// parent may not). Other systems have no portable way to list descriptors,
+	// so there it's up to the caller.
+	//
+	// Hardened or not, the child still inherits the parent's
+	// resource limits (see Rlimits), umask (see Umask), ignored
+	// signals, nice value, and on Linux its namespaces, cgroup,
+	// capability bounding set, no_new_privs and seccomp filters. On
+	// the BSDs and macOS, a new session also clears the login name
+	// set by setlogin(2).
+	Hardened bool
+
+	// HandshakeTimeout bounds how long to wait for a freshly
+	// started child to drop privileges before killing it and
+	// returning ErrHandshakeTimeout. Zero means
+	// DefaultHandshakeTimeout; negative means no limit.
+	HandshakeTimeout time.Duration
+
+	// ReadyTimeout, if positive, makes starting a child also wait,
+	// after it has dropped privileges, for it to be ready: for
+	// every function returned by DelayReady in the child to be
+	// called. A child that isn't ready in time is killed and the
+	// error is ErrNotReady. By default the parent doesn't wait.
+	ReadyTimeout time.Duration
+
+	// MaxCallDuration, if positive, bounds how long the child lets
+	// any one call run. Since net/rpc can't stop a method once it's
+	// running, a call that takes longer makes the child exit, so it
+	// and any other calls in flight fail as if the child had
+	// crashed; a Pool starts a new child next time. The package's
+	// own calls, such as the wait for ReadyTimeout, aren't bounded,
+	// but tasks are. Zero means no limit.
+	MaxCallDuration time.Duration
+
+	// AllowMethods, if non-empty, lists the only methods, as
+	// "Service.Method", that the child will serve, however many are
+	// registered, as a defense against exposing a dangerous one in
+	// the wrong place. Calls to others fail with an error saying
+	// so. The child reports what it was restricted to during the
+	// handshake, and fails to start if that doesn't match; see also
+	// Client.AllowedMethods. Internal methods such as RunNamed's
+	// and Client.AddService's need listing too, as
+	// "InternalGoRunAs.RunTask" and "InternalGoRunAs.AddService".
+	AllowMethods []string
+
+	// Stderr, if non-nil, receives everything the child writes to
+	// its stderr. Either way, the last few lines are included in
+	// the error if the child fails to start.
+	Stderr io.Writer
+
+	// LabelStderr, if true, starts each line copied to Stderr with
+	// the name (or, if unknown, the uid) of the user the child runs
+	// as and its pid, as in "nobody[1234]: ", to tell apart the
+	// output of several children sharing a Stderr.
+	LabelStderr bool
+
+	// Logger, if non-nil, receives diagnostics about the children c
+	// starts: when they start, drop privileges or fail to, and
+	// exit. By default nothing is logged.
+	Logger *slog.Logger
+
+	// Codec is the wire encoding between parent and child.
+	Codec Codec
+
+	// Socket, if true, connects to the child over a Unix domain
+	// socket pair instead of its stdin and stdout, leaving those
+	// free for other uses; by default they're the null device.
+	Socket bool
+
+	// TLS, if true, runs the socket connection, which it requires,
+	// over TLS keyed afresh for each child, so that even another
+	// process that gets hold of the socket can't send the child
+	// calls or read their results. The key is passed to the child
+	// through a pipe that's closed once read. It's off by default,
+	// since a socketpair is already private to the two processes.
+	TLS bool
+
+	// Transport, if set, names the transport, registered with
+	// RegisterTransport, to connect to the child with, instead of
+	// the one Socket and TLS choose; it can't be used with them.
+	// Unless it's PipeTransport, the child's stdin and stdout are
+	// left free, as with Socket.
+	Transport string
+
+	// PrepareCmd, if non-nil, is called with the child's command
+	// just before it's started, for changing anything Config has no
+	// field for. With PipeTransport, the default, Stdin and Stdout
+	// are the connection to the child and must not be replaced. Stderr is
+	// how its stderr is captured and should be left alone too, and
+	// ExtraFiles may only be appended to.
+	PrepareCmd func(cmd *exec.Cmd)
+}
+
+// Codec is an RPC encoding for talking to a child.
+type Codec int
+
+const (
+	// GobCodec is net/rpc's default encoding, encoding/gob.
+	GobCodec Codec = iota
+
+	// JSONCodec is JSON-RPC 1.0, as implemented by net/rpc/jsonrpc.
+	// It's easier to debug and to speak from other languages.
+	JSONCodec
+)
+
+func (c Codec) String() string {
+	switch c {
+	case GobCodec:
+		return "gob"
+	case JSONCodec:
+		return "json"
+	}
+	return "Codec(" + strconv.Itoa(int(c)) + ")"
+}
+
+// RegisterType registers value's concrete type with encoding/gob,
+// as gob.Register does, for service methods whose arguments or
+// replies hold it in an interface. Gob can only send such values if
+// both ends have registered the type, so call RegisterType before
+// MaybeRunChildServer, typically from init, which makes sure the
+// child, running the same binary, does too. Without it, calls fail
+// with an error that mentions RegisterType. JSONCodec can't decode
+// into interfaces at all.
+func RegisterType(value any) {
+	gob.Register(value)
+}
+
+// parseCodec is the inverse of Codec.String.
+func parseCodec(s string) (Codec, error) {
+	switch s {
+	case "gob":
+		return GobCodec, nil
+	case "json":
+		return JSONCodec, nil
+	}
+	return 0, fmt.Errorf("runas: unknown codec %q", s)
+}
+
+func (c Codec) clientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	if c == JSONCodec {
+		return jsonrpc.NewClientCodec(conn)
+	}
+	return newGobClientCodec(conn)
+}
+
+func (c Codec) serverCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	if c == JSONCodec {
+		return jsonrpc.NewServerCodec(conn)
+	}
+	return newGobServerCodec(conn)
+}
+
+// Rlimit is a resource limit for setrlimit(2).
+type Rlimit struct {
+	Resource int    // for example syscall.RLIMIT_NOFILE
+	Cur, Max uint64 // soft and hard limits
+
+	// Required is whether the child fails to start if the limit
+	// can't be set.
+	Required bool
+}
+
+// IDMap maps a range of ids in a user namespace to ids outside
+// it; see user_namespaces(7).
+type IDMap struct {
+	ContainerID int // first id inside the namespace
+	HostID      int // first id outside it
+	Size        int // number of ids
+}
+
+// DefaultHandshakeTimeout is the HandshakeTimeout used when a Config
+// doesn't set one.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// ErrHandshakeTimeout is returned when a child doesn't drop
+// privileges within the Config's HandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("runas: timed out waiting for child to drop privileges")
+
+// ErrNotRoot is wrapped by the error from starting a child when the
+// parent isn't root, which it has to be to drop to any uid or gid
+// but its own.
+var ErrNotRoot = errors.New("runas: must run as root")
+
+// UnknownUserError is returned when the user to drop to has no
+// passwd entry; it's permanent. Other failures to look a user up,
+// such as a directory service not answering, may be transient, and
+// are returned as other errors.
+type UnknownUserError struct {
+	User string // the username, or the uid in decimal
+	Err  error  // from package os/user
+}
+
+func (e *UnknownUserError) Error() string {
+	return "runas: unknown user " + e.User
+}
+
+func (e *UnknownUserError) Unwrap() error { return e.Err }
+
+// userLookupError returns the error for failing to look up name, a
+// username or uid, with err.
+func userLookupError(name string, err error) error {
+	var unknownName user.UnknownUserError
+	var unknownId user.UnknownUserIdError
+	if errors.As(err, &unknownName) || errors.As(err, &unknownId) {
+		return &UnknownUserError{User: name, Err: err}
+	}
+	return fmt.Errorf("runas: looking up user %s: %w", name, err)
+}
+
+// DropError is returned when a started child fails to drop
+// privileges. The child has been killed.
+type DropError struct {
+	Uid, Gid int // what the child was dropping to
+
+	// GroupsSet, GidDropped and UidDropped report how far the
+	// child got, in that order, before it stopped.
+	GroupsSet, GidDropped, UidDropped bool
+
+	// SetgroupsErrno, SetuidErrno and SetgidErrno are why setgroups,
+	// setuid or setgid failed, if it did, or zero.
+	SetgroupsErrno, SetuidErrno, SetgidErrno syscall.Errno
+
+	// Err is what went wrong. If a system call failed in a way the
+	// parent can see, Err wraps its syscall.Errno, so that, for
+	// example, errors.Is(err, syscall.EPERM) reports a child that
+	// lacked a privilege it needed.
+	Err error
+}
+
+func (e *DropError) Error() string {
+	return fmt.Sprintf("runas: failed to drop root to %d/%d: %v", e.Uid, e.Gid, e.Err)
+}
+
+func (e *DropError) Unwrap() error { return e.Err }
+
+func (c *Config) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return discardLogger
+}
+
+// discardLogger has every level disabled, so logging to it is cheap.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(math.MaxInt)}))
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout == 0 {
+		return DefaultHandshakeTimeout
+	}
+	return c.HandshakeTimeout
+}
+
+// childEnv returns the environment for a child started by c to run
+// as u. u may be nil if the user isn't known. Later entries override
+// earlier ones, as os/exec does with duplicates.
+func (c *Config) childEnv(u *user.User) ([]string, error) {
+	var env []string
+	for _, pat := range c.ScrubEnv {
+		if _, err := path.Match(pat, ""); err != nil {
+			return nil, fmt.Errorf("runas: bad ScrubEnv pattern %q: %w", pat, err)
+		}
+	}
+	if c.ScrubEnv != nil {
+		for _, kv := range os.Environ() {
+			if name, _, _ := strings.Cut(kv, "="); !scrubbed(name, c.ScrubEnv) {
+				env = append(env, kv)
+			}
+		}
+	}
+	if u != nil && !c.MinimalEnv {
+		shell := loginShell(u)
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		env = append(env,
+			"HOME="+u.HomeDir,
+			"USER="+u.Username,
+			"LOGNAME="+u.Username,
+			"SHELL="+shell,
+		)
+	}
+	if c.LocaleEnv {
+		for _, kv := range os.Environ() {
+			if name, _, _ := strings.Cut(kv, "="); isLocaleVar(name) {
+				env = append(env, kv)
+			}
+		}
+	}
+	for _, kv := range c.ExtraEnv {
+		if strings.Contains(kv, "=") {
+			env = append(env, kv)
+		} else if v, ok := os.LookupEnv(kv); ok {
+			env = append(env, kv+"="+v)
+		}
+	}
+	// Last, so ExtraEnv can't override it.
+	return append(env, ChildEnvVar+"=1"), nil
+}
+
+// isLocaleVar reports whether name is one of the variables
+// LocaleEnv copies.
+func isLocaleVar(name string) bool {
+	return name == "TZ" || name == "LANG" || strings.HasPrefix(name, "LC_")
+}
+
+// scrubbed reports whether the inherited variable name should be
+// left out of a child's environment. The parent's own runas
+// variables, if it's a child itself, are never passed on.
+func scrubbed(name string, patterns []string) bool {
+	if name == ChildEnvVar || strings.HasPrefix(name, "BECOME_GO_RUNAS_") {
+		return true
+	}
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// User is like UserContext but starts the child as configured by c.
+func (c *Config) User(ctx context.Context, username string) (*Client, error) {
+	arg, u, err := lookupUser(username)
+	if err != nil {
+		return nil, err
+	}
+	return c.spawn(ctx, arg, u)
+}
+
+// Uid is like the package-level Uid but starts the child as
+// configured by c.
+func (c *Config) Uid(ctx context.Context, uid int) (*Client, error) {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return nil, userLookupError(strconv.Itoa(uid), err)
+	}
+	arg, err := userDropArg(u)
+	if err != nil {
+		return nil, err
+	}
+	return c.spawn(ctx, arg, u)
+}
+
+// UserGroup is like the package-level UserGroup but starts the
+// child as configured by c.
+func (c *Config) UserGroup(ctx context.Context, username, groupname string) (*Client, error) {
+	arg, u, err := lookupUser(username)
+	if err != nil {
+		return nil, err
+	}
+	g, err := user.LookupGroup(groupname)
+	if err != nil {
+		return nil, fmt.Errorf("runas: looking up group %q: %w", groupname, err)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("runas: bad group id %q for %s", g.Gid, groupname)
+	}
+	arg.Gid = gid
+	if !slices.Contains(arg.Groups, gid) {
+		arg.Groups = append(arg.Groups, gid)
+	}
+	return c.spawn(ctx, arg, u)
+}
+
+// userDropArg returns how to drop privileges to u.
+func userDropArg(u *user.User) (*internalDropArg, error) {
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	groups, err := groupIds(u)
+	if err != nil {
+		return nil, err
+	}
+	return &internalDropArg{Uid: uid, Gid: gid, Groups: groups}, nil
+}
+
+// groupIds returns the numeric ids of all the groups u is a member
+// of, as initgroups(3) would set them.
+func groupIds(u *user.User) ([]int, error) {
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("runas: failed to look up groups of %s: %w", u.Username, err)
+	}
+	groups := make([]int, 0, len(ids))
+	for _, id := range ids {
+		gid, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("runas: bad group id %q for %s", id, u.Username)
+		}
+		groups = append(groups, gid)
+	}
+	return groups, nil
+}
+
+// DropTo is like the package-level DropTo but starts the child as
+// configured by c.
+func (c *Config) DropTo(ctx context.Context, spec string) (*Client, error) {
+	uidStr, gidStr, ok := strings.Cut(spec, ":")
+	if !ok {
+		if spec == "" {
+			return nil, errors.New("runas: empty user")
+		}
+		return c.User(ctx, spec)
+	}
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil || uid < 0 {
+		return nil, fmt.Errorf("runas: bad uid in %q; want a username or uid:gid", spec)
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil || gid < 0 {
+		return nil, fmt.Errorf("runas: bad gid in %q; want a username or uid:gid", spec)
+	}
+	return c.UidGid(ctx, uid, gid)
+}
+
+// nobodyId is the traditional uid and gid of nobody, used when the
+// system has no nobody user.
+const nobodyId = 65534
+
+// Nobody is like the package-level DropToNobody but starts the
+// child as configured by c.
+func (c *Config) Nobody(ctx context.Context) (*Client, error) {
+	arg := &internalDropArg{Uid: nobodyId, Gid: nobodyId}
+	var u *user.User
+	if nu, err := user.Lookup("nobody"); err == nil {
+		uid, uerr := strconv.Atoi(nu.Uid)
+		gid, gerr := strconv.Atoi(nu.Gid)
+		// Distros disagree on nobody's group, nogroup or nobody, and
+		// sometimes its ids, so go by its passwd entry, so long as
+		// it's sane.
+		if uerr == nil && gerr == nil && uid != 0 && gid != 0 {
+			arg.Uid, arg.Gid, u = uid, gid, nu
+		}
+	}
+	// Never nobody's supplementary groups, if any.
+	arg.Groups = []int{arg.Gid}
+	return c.spawn(ctx, arg, u)
+}
+
+// UidGid is like UidGidContext but starts the child as configured
+// by c.
+func (c *Config) UidGid(ctx context.Context, uid, gid int) (*Client, error) {
+	arg := &internalDropArg{Uid: uid, Gid: gid, Groups: []int{gid}}
+	var u *user.User
+	if c.InitGroups {
+		var err error
+		if u, err = user.LookupId(strconv.Itoa(uid)); err != nil {
+			return nil, userLookupError(strconv.Itoa(uid), err)
+		}
+		if arg.Groups, err = groupIds(u); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(arg.Groups, gid) {
+			arg.Groups = append(arg.Groups, gid)
+		}
+	} else if !c.MinimalEnv {
+		// Only used for the environment, so it's fine if uid
+		// has no passwd entry.
+		u, _ = user.LookupId(strconv.Itoa(uid))
+	}
+	return c.spawn(ctx, arg, u)
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import "syscall"
+
+// FreeBSD has setresuid and setresgid too, though package syscall
+// only exposes them as system call numbers. As on Linux, they set
+// the real, effective and saved ids in one call. Unlike on Linux,
+// credentials belong to the process rather than each thread, so one
+// call on any thread does it.
+const dropMechanism = "setresuid"
+
+func setuid(uid int) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESUID, uintptr(uid), uintptr(uid), uintptr(uid)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setgid(gid int) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESGID, uintptr(gid), uintptr(gid), uintptr(gid)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ngroupsMax is FreeBSD's NGROUPS_MAX. Before FreeBSD 14, setgroups
+// also sets the effective gid from the first entry, which is why
+// the primary group goes first; see groupList.
+const ngroupsMax = 1023
@@ -0,0 +1,388 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// On Linux, setresuid and setresgid set the real, effective and
+// saved ids in one call, so there's no saved root id that a
+// compromised child could switch back to.
+const dropMechanism = "setresuid"
+
+func setuid(uid int) error {
+	return syscall.Setresuid(uid, uid, uid)
+}
+
+func setgid(gid int) error {
+	return syscall.Setresgid(gid, gid, gid)
+}
+
+// runningBinary returns the path of the running binary, whatever
+// os.Args[0] says. If it's been deleted or replaced on disk, as by a
+// deploy, that's /proc/self/exe, which is the running image still;
+// otherwise it's the file's real path, so that the child's process
+// name is the binary's, not "exe".
+func runningBinary() string {
+	const exe = "/proc/self/exe"
+	path, err := os.Readlink(exe)
+	if err != nil {
+		return ""
+	}
+	if strings.HasSuffix(path, " (deleted)") {
+		return exe
+	}
+	return path
+}
+
+// canWaitNoReap is whether waitNoReap works.
+const canWaitNoReap = true
+
+// waitNoReap waits for the child pid to exit, leaving it to be
+// reaped.
+func waitNoReap(pid int) error {
+	const pPid = 1     // P_PID, from <sys/wait.h>
+	var info [128]byte // siginfo_t
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPid, uintptr(pid), uintptr(unsafe.Pointer(&info[0])), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		if errno != syscall.EINTR {
+			if errno != 0 {
+				return errno
+			}
+			return nil
+		}
+	}
+}
+
+// ngroupsMax is Linux's NGROUPS_MAX, the most supplementary groups
+// setgroups accepts.
+const ngroupsMax = 65536
+
+// From <linux/prctl.h> and <linux/seccomp.h>.
+const (
+	prSetPdeathsig         = 1
+	prSetDumpable          = 4
+	prSetNoNewPrivs        = 38
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+)
+
+// setUserNamespace has attr start the child in a new user namespace
+// with c's id maps. Only root may allow setgroups in the child; see
+// internalDropArg.SetgroupsDenied.
+func setUserNamespace(attr *syscall.SysProcAttr, c *Config) error {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	attr.UidMappings = sysIDMaps(c.UidMappings)
+	attr.GidMappings = sysIDMaps(c.GidMappings)
+	attr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+	return nil
+}
+
+// setMountNamespace has attr start the child in a new mount
+// namespace.
+func setMountNamespace(attr *syscall.SysProcAttr) error {
+	attr.Cloneflags |= syscall.CLONE_NEWNS
+	return nil
+}
+
+// makeMountsPrivate stops mount events in the child's new mount
+// namespace from propagating back to the parent's, as they would
+// from mounts marked shared, which systemd makes them all.
+func makeMountsPrivate() error {
+	return syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+}
+
+// remountReadOnly makes the mount at dir read-only, leaving the
+// mounts under it alone. A dir other than / is first bind-mounted,
+// along with what's mounted under it, onto itself, so that it's a
+// mount of its own.
+func remountReadOnly(dir string) error {
+	if dir != "/" {
+		if err := syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	// A remount has to repeat the flags the mount has, since in a
+	// user namespace the kernel refuses to clear ones that are
+	// locked, such as nosuid.
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for _, f := range statfsMountFlags {
+		if int64(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	return syscall.Mount("", dir, "", flags, "")
+}
+
+// statfsMountFlags pairs statfs(2)'s ST_ flags, which syscall doesn't
+// define, with the mount flags they report.
+var statfsMountFlags = []struct {
+	st int64
+	ms uintptr
+}{
+	{2, syscall.MS_NOSUID},
+	{4, syscall.MS_NODEV},
+	{8, syscall.MS_NOEXEC},
+	{1024, syscall.MS_NOATIME},
+	{2048, syscall.MS_NODIRATIME},
+	{4096, syscall.MS_RELATIME},
+}
+
+func sysIDMaps(maps []IDMap) []syscall.SysProcIDMap {
+	var sys []syscall.SysProcIDMap
+	for _, m := range maps {
+		sys = append(sys, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	return sys
+}
+
+// setParentDeathSignal makes the kernel kill the child if the
+// parent dies. The signal is sent when the thread that started the
+// child exits rather than the whole parent, which in Go only happens
+// to a thread locked by a goroutine that exited without unlocking.
+func setParentDeathSignal(attr *syscall.SysProcAttr) {
+	attr.Pdeathsig = syscall.SIGKILL
+}
+
+// rearmParentDeathSignal sets the parent-death signal again, since
+// the kernel clears it when the child changes ids. If the parent,
+// ppid, died in between, nothing would send it, so the child just
+// exits.
+func rearmParentDeathSignal(ppid int) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetPdeathsig, uintptr(syscall.SIGKILL), 0); errno != 0 {
+		return errno
+	}
+	if os.Getppid() != ppid {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// setNotDumpable marks the process not dumpable, which also keeps
+// processes without CAP_SYS_PTRACE from tracing it.
+func setNotDumpable() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetDumpable, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setNoNewPrivs sets no_new_privs. It's per-thread state, so it has
+// to be set on every thread of the runtime. The runtime can't do
+// that in binaries that use cgo, and prctl only sets it on the
+// calling thread, so there it's spread to the rest by installing a
+// seccomp filter that allows everything.
+func setNoNewPrivs() error {
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0)
+	if errno == syscall.ENOTSUP {
+		return seccompAllThreads(allowAll)
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// allowAll is a seccomp filter that allows every syscall.
+var allowAll = []syscall.SockFilter{{Code: 0x06, K: 0x7fff0000}} // ret ALLOW
+
+// installSeccomp installs prog on every thread, after setting
+// no_new_privs, which an unprivileged process needs to install a
+// filter.
+func installSeccomp(prog []BPFInstruction) error {
+	filter := make([]syscall.SockFilter, len(prog))
+	for i, ins := range prog {
+		filter[i] = syscall.SockFilter{Code: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return seccompAllThreads(filter)
+}
+
+// seccompAllThreads sets no_new_privs on the calling thread and
+// installs filter with seccomp(2)'s TSYNC flag, which installs it on
+// every thread of the process and spreads no_new_privs to them too.
+// Unlike AllThreadsSyscall, that works in binaries that use cgo.
+func seccompAllThreads(filter []syscall.SockFilter) error {
+	if sysSeccomp == 0 {
+		return syscall.ENOSYS
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errno
+	}
+	fprog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	tid, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return errno
+	}
+	if tid != 0 {
+		// Some thread already has a filter that isn't one of ours.
+		return fmt.Errorf("thread %d can't take the filter", tid)
+	}
+	return nil
+}
+
+// sysSeccomp is seccomp(2)'s number, which package syscall lacks for
+// some architectures, or 0 if it's not known here.
+var sysSeccomp = map[string]uintptr{
+	"386":      354,
+	"amd64":    317,
+	"arm":      383,
+	"arm64":    277,
+	"loong64":  277,
+	"mips":     4352,
+	"mipsle":   4352,
+	"mips64":   5312,
+	"mips64le": 5312,
+	"ppc64":    358,
+	"ppc64le":  358,
+	"riscv64":  277,
+	"s390x":    348,
+}[runtime.GOARCH]
+
+// setProcessName sets the name of the process's main thread, which
+// is what ps shows. Once the child has dropped privileges its /proc
+// entries belong to root, so this has to happen before.
+func setProcessName(name string) error {
+	return os.WriteFile("/proc/self/comm", []byte(name), 0)
+}
+
+// setOomScoreAdj sets the process's oom_score_adj. Lowering it
+// needs CAP_SYS_RESOURCE, and /proc, so it has to happen while root
+// and before any chroot.
+func setOomScoreAdj(adj int) error {
+	f, err := os.OpenFile("/proc/self/oom_score_adj", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strconv.Itoa(adj))
+	return err
+}
+
+// cpuMask is a CPU affinity mask, as glibc's cpu_set_t.
+type cpuMask [1024 / 64]uint64
+
+// setCPUAffinity confines every thread of the process to cpus.
+func setCPUAffinity(cpus []int) error {
+	mask := new(cpuMask)
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= len(mask)*64 {
+			return syscall.EINVAL
+		}
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	return allThreads(syscall.SYS_SCHED_SETAFFINITY, 0, 0, unsafe.Sizeof(*mask), uintptr(unsafe.Pointer(mask)))
+}
+
+// setNice sets the nice value of every thread of the process.
+func setNice(nice int) error {
+	return allThreads(syscall.SYS_SETPRIORITY, 1, syscall.PRIO_PROCESS, 0, uintptr(nice))
+}
+
+// getNice returns the calling thread's nice value. The raw syscall
+// returns 20 minus it, so as never to look like an error.
+func getNice() (int, error) {
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	return 20 - prio, err
+}
+
+// allThreads makes the syscall trap with args a1, a2 and a3 on
+// every thread of the process, for settings such as CPU affinity and
+// nice value that Linux keeps per thread, and that new threads
+// inherit from the one that starts them. The syscall must take a
+// thread id, as argument number tidArg counting from 0, for which 0
+// means the calling thread.
+//
+//go:uintptrescapes
+func allThreads(trap uintptr, tidArg int, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	if errno == syscall.ENOTSUP {
+		// AllThreadsSyscall doesn't work with cgo, so do each thread
+		// in turn, until a pass over them finds none not done, in
+		// case one started a thread in between.
+		args := [3]uintptr{a1, a2, a3}
+		done := make(map[int]bool)
+		for {
+			ents, err := os.ReadDir("/proc/self/task")
+			if err != nil {
+				return err
+			}
+			found := false
+			for _, e := range ents {
+				tid, err := strconv.Atoi(e.Name())
+				if err != nil || done[tid] {
+					continue
+				}
+				args[tidArg] = uintptr(tid)
+				_, _, errno := syscall.RawSyscall(trap, args[0], args[1], args[2])
+				if errno != 0 && errno != syscall.ESRCH {
+					return errno
+				}
+				done[tid] = true
+				found = true
+			}
+			if !found {
+				return nil
+			}
+		}
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// inheritableFd returns the lowest descriptor above stderr, other
+// than those in skip, that the process has open without
+// close-on-exec, so that a child would inherit it, or -1 if there's
+// none.
+func inheritableFd(skip []int) (int, error) {
+	ents, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1, err
+	}
+	low := -1
+	for _, ent := range ents {
+		fd, err := strconv.Atoi(ent.Name())
+		if err != nil || fd <= 2 || (low != -1 && fd > low) || slices.Contains(skip, fd) {
+			continue
+		}
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+		if errno != 0 {
+			// Probably the directory we just read, since closed.
+			continue
+		}
+		if flags&syscall.FD_CLOEXEC == 0 {
+			low = fd
+		}
+	}
+	return low, nil
+}
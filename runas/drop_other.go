@@ -0,0 +1,136 @@
+//go:build !linux && !windows
+
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setUserNamespace(attr *syscall.SysProcAttr, c *Config) error {
+	return errors.New("runas: user namespaces are only supported on Linux")
+}
+
+func setMountNamespace(attr *syscall.SysProcAttr) error {
+	return errors.New("runas: mount namespaces are only supported on Linux")
+}
+
+func makeMountsPrivate() error {
+	return errors.New("mount namespaces are only supported on Linux")
+}
+
+func remountReadOnly(dir string) error {
+	return errors.New("mount namespaces are only supported on Linux")
+}
+
+// runningBinary can't tell: there's no portable way to find the
+// running binary, so os.Args[0] has to do.
+func runningBinary() string {
+	return ""
+}
+
+// canWaitNoReap is false: waitid(2), with WNOWAIT, is only used on
+// Linux.
+const canWaitNoReap = false
+
+func waitNoReap(pid int) error {
+	return errors.ErrUnsupported
+}
+
+// setParentDeathSignal does nothing: only Linux has a parent-death
+// signal that this package sets.
+func setParentDeathSignal(attr *syscall.SysProcAttr) {}
+
+func rearmParentDeathSignal(ppid int) error {
+	return nil
+}
+
+// setNoNewPrivs does nothing: no_new_privs is Linux-only.
+func setNoNewPrivs() error {
+	return nil
+}
+
+// installSeccomp fails: seccomp is Linux-only, and a child that
+// asked for a filter mustn't run without one.
+func installSeccomp(prog []BPFInstruction) error {
+	return errors.New("seccomp is only supported on Linux")
+}
+
+// setProcessName does nothing; there's no portable way to rename a
+// running process.
+func setProcessName(name string) error {
+	return nil
+}
+
+// setNotDumpable does nothing: dumpability is Linux-only, and the
+// core limit is what matters elsewhere.
+func setNotDumpable() error {
+	return nil
+}
+
+// setOomScoreAdj does nothing: oom_score_adj is Linux-only.
+func setOomScoreAdj(adj int) error {
+	return nil
+}
+
+// setCPUAffinity does nothing: sched_setaffinity is Linux-only.
+func setCPUAffinity(cpus []int) error {
+	return nil
+}
+
+func setNice(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice)
+}
+
+func getNice() (int, error) {
+	return syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+}
+
+// inheritableFd finds nothing: there's no portable way to list a
+// process's descriptors.
+func inheritableFd(skip []int) (int, error) {
+	return -1, nil
+}
+
+// Capabilities are Linux-only.
+
+const (
+	capSetgid = -1
+	capSetuid = -1
+)
+
+func probeSandbox() (caps uint64, capsKnown bool, seccompMode int) {
+	return 0, false, -1
+}
+
+func parseCaps(names []string) ([]int, error) {
+	return nil, errors.New("runas: capabilities are only supported on Linux")
+}
+
+func checkCaps() error {
+	return nil
+}
+
+func setKeepCaps(keep bool) error {
+	return errors.New("capabilities are only supported on Linux")
+}
+
+func limitCaps(caps []int) error {
+	return errors.New("capabilities are only supported on Linux")
+}
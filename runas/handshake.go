@@ -0,0 +1,319 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The handshake, the parent's internalDropArg and the child's
+// internalDropResult, is sent before the connection carries any rpc
+// traffic, each as one frame: a 4-byte big-endian length and then
+// the fields in the order listed by their wire methods. It's done by
+// hand rather than as an rpc call because it's the one exchange every
+// child makes, and in a fresh process gob or JSON's reflection on
+// these structs costs a noticeable fraction of spawning one.
+//
+// Both ends are always the same package, so there's no versioning:
+// a field added to either struct must be added to its wire method.
+
+// maxHandshakeFrame bounds a frame's length, mostly ChildConfig.
+const maxHandshakeFrame = 64 << 20
+
+var errMalformed = errors.New("malformed frame")
+
+// wire encodes or decodes the fields of a handshake frame. One method
+// per struct lists its fields for both, so they can't disagree.
+type wire struct {
+	buf []byte // appended to when encoding, consumed when decoding
+	dec bool
+	err error // the first decoding error
+}
+
+func (w *wire) uvarint(v *uint64) {
+	if !w.dec {
+		w.buf = binary.AppendUvarint(w.buf, *v)
+		return
+	}
+	if w.err != nil {
+		return
+	}
+	n, k := binary.Uvarint(w.buf)
+	if k <= 0 {
+		w.err = errMalformed
+		return
+	}
+	*v, w.buf = n, w.buf[k:]
+}
+
+// The other primitives only store into v when decoding, so that
+// encoding never changes the fields it's given.
+
+func (w *wire) int64(v *int64) {
+	u := uint64(*v<<1 ^ *v>>63) // zigzag, as binary.PutVarint
+	w.uvarint(&u)
+	if w.dec {
+		*v = int64(u>>1) ^ -int64(u&1)
+	}
+}
+
+func (w *wire) int(v *int) {
+	x := int64(*v)
+	w.int64(&x)
+	if w.dec {
+		*v = int(x)
+	}
+}
+
+func (w *wire) uintptr(v *uintptr) {
+	u := uint64(*v)
+	w.uvarint(&u)
+	if w.dec {
+		*v = uintptr(u)
+	}
+}
+
+func (w *wire) bool(v *bool) {
+	var u uint64
+	if *v {
+		u = 1
+	}
+	w.uvarint(&u)
+	if w.dec {
+		*v = u != 0
+	}
+}
+
+// length encodes or decodes n, and whether there's anything at all,
+// for slices and pointers whose nil means something different from
+// empty. It reports whether there is.
+func (w *wire) length(n *int, present bool) bool {
+	u := uint64(0)
+	if present {
+		u = uint64(*n) + 1
+	}
+	w.uvarint(&u)
+	if u == 0 || w.err != nil {
+		return false
+	}
+	if w.dec && u-1 > uint64(len(w.buf)) {
+		// Every element takes at least a byte.
+		w.err = errMalformed
+		return false
+	}
+	*n = int(u - 1)
+	return true
+}
+
+func (w *wire) bytes(v *[]byte) {
+	n := len(*v)
+	if !w.length(&n, *v != nil) {
+		return
+	}
+	if !w.dec {
+		w.buf = append(w.buf, *v...)
+		return
+	}
+	*v, w.buf = append([]byte{}, w.buf[:n]...), w.buf[n:]
+}
+
+func (w *wire) string(v *string) {
+	b := []byte(*v)
+	w.bytes(&b)
+	if w.dec {
+		*v = string(b)
+	}
+}
+
+func (w *wire) intPtr(v **int) {
+	n := 0
+	if !w.length(&n, *v != nil) {
+		return
+	}
+	if w.dec {
+		*v = new(int)
+	}
+	w.int(*v)
+}
+
+// slice encodes or decodes s with elem for each element.
+func slice[T any](w *wire, s *[]T, elem func(*T)) {
+	n := len(*s)
+	if !w.length(&n, *s != nil) {
+		return
+	}
+	if w.dec {
+		*s = make([]T, n)
+	}
+	for i := range *s {
+		elem(&(*s)[i])
+	}
+}
+
+func (a *internalDropArg) wire(w *wire) {
+	w.int(&a.Uid)
+	w.int(&a.Gid)
+	slice(w, &a.Groups, w.int)
+	w.string(&a.Chroot)
+	w.string(&a.Setup)
+	w.bool(&a.MountNamespace)
+	w.bool(&a.ReadOnlyRoot)
+	w.string(&a.WorkingDir)
+	w.intPtr(&a.Umask)
+	w.intPtr(&a.OomScoreAdj)
+	slice(w, &a.CPUAffinity, w.int)
+	w.intPtr(&a.Nice)
+	slice(w, &a.Rlimits, func(r *Rlimit) {
+		w.int(&r.Resource)
+		w.uvarint(&r.Cur)
+		w.uvarint(&r.Max)
+		w.bool(&r.Required)
+	})
+	w.bool(&a.DisableCoreDumps)
+	w.bool(&a.NoNewPrivs)
+	w.string(&a.SeccompFilter)
+	slice(w, &a.Capabilities, w.int)
+	w.string(&a.ProcessName)
+	w.bool(&a.EffectiveOnly)
+	w.bool(&a.SetgroupsDenied)
+	w.int(&a.ParentPid)
+	slice(w, &a.AllowedMethods, w.string)
+	w.bytes(&a.ChildConfig)
+	w.int64((*int64)(&a.MaxCallDuration))
+	w.bool(&a.RefuseInternal)
+}
+
+func (r *internalDropResult) wire(w *wire) {
+	w.bool(&r.UidDropped)
+	w.bool(&r.GidDropped)
+	w.uintptr(&r.SetuidErrno)
+	w.uintptr(&r.SetgidErrno)
+	w.bool(&r.GroupsSet)
+	w.uintptr(&r.SetgroupsErrno)
+	w.bool(&r.GroupsKept)
+	slice(w, &r.Groups, w.int)
+	w.int(&r.StartEuid)
+	w.uvarint(&r.Caps)
+	w.bool(&r.CapsKnown)
+	w.int(&r.SeccompMode)
+	w.string(&r.Mechanism)
+	w.int(&r.Uid)
+	w.int(&r.Euid)
+	w.int(&r.Gid)
+	w.int(&r.Egid)
+	w.bool(&r.RegainRefused)
+	slice(w, &r.RlimitErrnos, w.uintptr)
+	slice(w, &r.AllowedMethods, w.string)
+	w.uintptr(&r.NoNewPrivsErrno)
+	w.uintptr(&r.CoreDumpsErrno)
+	w.uintptr(&r.OomScoreAdjErrno)
+	w.uintptr(&r.CPUAffinityErrno)
+	w.uintptr(&r.NiceErrno)
+	w.int(&r.Nice)
+}
+
+func writeFrame(conn io.Writer, fields func(*wire)) error {
+	w := &wire{buf: make([]byte, 4, 256)}
+	fields(w)
+	n := len(w.buf) - 4
+	if n > maxHandshakeFrame {
+		return fmt.Errorf("frame of %d bytes is too large", n)
+	}
+	binary.BigEndian.PutUint32(w.buf, uint32(n))
+	_, err := conn.Write(w.buf)
+	return err
+}
+
+func readFrame(conn io.Reader, fields func(*wire)) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxHandshakeFrame {
+		return fmt.Errorf("frame of %d bytes is too large", n)
+	}
+	w := &wire{buf: make([]byte, n), dec: true}
+	if _, err := io.ReadFull(conn, w.buf); err != nil {
+		return err
+	}
+	fields(w)
+	if w.err == nil && len(w.buf) != 0 {
+		w.err = errMalformed
+	}
+	return w.err
+}
+
+// handshake does the parent's side of the handshake on conn, asking
+// the child to drop privileges as arg says and filling in res. The
+// error is the child's if it failed outright; otherwise res says how
+// it went.
+func handshake(conn io.ReadWriter, arg *internalDropArg, res *internalDropResult) error {
+	if err := writeFrame(conn, arg.wire); err != nil {
+		return fmt.Errorf("runas: failed to send handshake: %w", err)
+	}
+	var msg string
+	err := readFrame(conn, func(w *wire) {
+		w.string(&msg)
+		res.wire(w)
+	})
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("runas: child exited during handshake")
+	}
+	if err != nil {
+		return fmt.Errorf("runas: failed to read handshake reply: %w", err)
+	}
+	if msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// serveHandshake does the child's side of the handshake on conn,
+// before anything else is served. It only returns if the child
+// dropped privileges, or if conn closed before the parent asked
+// anything, in which case it returns io.EOF; otherwise the child
+// replies and exits.
+func serveHandshake(conn io.ReadWriter) error {
+	var arg internalDropArg
+	if err := readFrame(conn, arg.wire); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return fmt.Errorf("runas: failed to read handshake: %w", err)
+	}
+	var res internalDropResult
+	ok, err := childDrop(&arg, &res)
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+	werr := writeFrame(conn, func(w *wire) {
+		w.string(&msg)
+		res.wire(w)
+	})
+	if !ok || werr != nil {
+		// Partly dropped, or not at all, or with no way to tell the
+		// parent: either way, not fit to serve anything.
+		os.Exit(1)
+	}
+	return nil
+}
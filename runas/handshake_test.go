@@ -0,0 +1,271 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func intp(v int) *int { return &v }
+
+// roundTrip encodes v's fields with fields as a frame, decodes them
+// into a zero *T, and returns it.
+func roundTrip[T any](t *testing.T, v *T, fields func(*T, *wire)) *T {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, func(w *wire) { fields(v, w) }); err != nil {
+		t.Fatal(err)
+	}
+	got := new(T)
+	if err := readFrame(&buf, func(w *wire) { fields(got, w) }); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestHandshakeArgRoundTrip(t *testing.T) {
+	tests := []internalDropArg{
+		{},
+		{
+			Uid:    -1,
+			Gid:    -2,
+			Groups: []int{},
+			Umask:  intp(0),
+			Nice:   intp(-20),
+
+			CPUAffinity:    []int{},
+			Rlimits:        []Rlimit{},
+			Capabilities:   []int{},
+			AllowedMethods: []string{},
+			ChildConfig:    []byte{},
+		},
+		{
+			Uid:            1001,
+			Gid:            1002,
+			Groups:         []int{1002, 1003, 65534},
+			Chroot:         "/var/empty",
+			Setup:          "setup",
+			MountNamespace: true,
+			ReadOnlyRoot:   true,
+			WorkingDir:     "/",
+			Umask:          intp(0o077),
+			OomScoreAdj:    intp(-1000),
+			CPUAffinity:    []int{0, 3},
+			Nice:           intp(19),
+			Rlimits: []Rlimit{
+				{Resource: 7, Cur: 1024, Max: 4096, Required: true},
+				{Resource: 4, Cur: ^uint64(0), Max: ^uint64(0)},
+			},
+			DisableCoreDumps: true,
+			NoNewPrivs:       true,
+			SeccompFilter:    "filter",
+			Capabilities:     []int{10, 12},
+			ProcessName:      "worker",
+			EffectiveOnly:    true,
+			SetgroupsDenied:  true,
+			ParentPid:        1,
+			AllowedMethods:   []string{"S.A", "S.B"},
+			ChildConfig:      []byte("config\x00"),
+			MaxCallDuration:  5 * time.Second,
+			RefuseInternal:   true,
+		},
+		{MaxCallDuration: -1 << 62},
+	}
+	for i, arg := range tests {
+		orig := arg
+		got := roundTrip(t, &arg, (*internalDropArg).wire)
+		if !reflect.DeepEqual(*got, orig) {
+			t.Errorf("%d: round trip = %+v; want %+v", i, *got, orig)
+		}
+		if !reflect.DeepEqual(arg, orig) {
+			t.Errorf("%d: encoding changed arg to %+v", i, arg)
+		}
+	}
+}
+
+func TestHandshakeResultRoundTrip(t *testing.T) {
+	tests := []internalDropResult{
+		{},
+		{Groups: []int{}, RlimitErrnos: []uintptr{}, AllowedMethods: []string{}, Nice: -5},
+		{
+			UidDropped:       true,
+			GidDropped:       true,
+			SetuidErrno:      1,
+			SetgidErrno:      2,
+			GroupsSet:        true,
+			SetgroupsErrno:   3,
+			GroupsKept:       true,
+			Groups:           []int{0, 1002},
+			StartEuid:        0,
+			Caps:             1<<63 | 1,
+			CapsKnown:        true,
+			SeccompMode:      2,
+			Mechanism:        "setresuid",
+			Uid:              1001,
+			Euid:             1001,
+			Gid:              -1,
+			Egid:             1002,
+			RegainRefused:    true,
+			RlimitErrnos:     []uintptr{0, 22},
+			AllowedMethods:   []string{"S.A"},
+			NoNewPrivsErrno:  4,
+			CoreDumpsErrno:   5,
+			OomScoreAdjErrno: 6,
+			CPUAffinityErrno: 7,
+			NiceErrno:        8,
+			Nice:             19,
+		},
+	}
+	for i, res := range tests {
+		got := roundTrip(t, &res, (*internalDropResult).wire)
+		if !reflect.DeepEqual(*got, res) {
+			t.Errorf("%d: round trip = %+v; want %+v", i, *got, res)
+		}
+	}
+}
+
+// frame returns payload as a frame.
+func frame(payload ...byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	var arg internalDropArg
+	valid := new(bytes.Buffer)
+	if err := writeFrame(valid, arg.wire); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		in   []byte
+		want error // nil to only require an error
+	}{
+		{"empty", nil, io.EOF},
+		{"short header", []byte{0, 0}, io.ErrUnexpectedEOF},
+		{"truncated frame", valid.Bytes()[:valid.Len()-1], io.ErrUnexpectedEOF},
+		{"oversized length", binary.BigEndian.AppendUint32(nil, maxHandshakeFrame+1), nil},
+		{"truncated field", frame(0, 0, 0x80), errMalformed},
+		{"length past the end", frame(0, 0, 0, 100, 'a'), errMalformed},
+		{"trailing bytes", frame(append(bytes.Clone(valid.Bytes()[4:]), 0)...), errMalformed},
+	}
+	for _, tt := range tests {
+		var got internalDropArg
+		err := readFrame(bytes.NewReader(tt.in), got.wire)
+		switch {
+		case err == nil:
+			t.Errorf("%s: no error", tt.name)
+		case tt.want != nil && !errors.Is(err, tt.want):
+			t.Errorf("%s: error = %v; want %v", tt.name, err, tt.want)
+		case tt.want == nil && !strings.Contains(err.Error(), "too large"):
+			t.Errorf("%s: error = %v; want too large", tt.name, err)
+		}
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	arg := internalDropArg{ChildConfig: make([]byte, maxHandshakeFrame)}
+	if err := writeFrame(io.Discard, arg.wire); err == nil {
+		t.Error("no error")
+	}
+}
+
+// BenchDropArg and BenchDropResult let BenchmarkHandshake make the
+// handshake as the rpc call it used to be.
+type (
+	BenchDropArg    internalDropArg
+	BenchDropResult internalDropResult
+)
+
+type benchService struct{}
+
+func (benchService) Drop(arg *BenchDropArg, res *BenchDropResult) error {
+	res.UidDropped, res.GidDropped = true, true
+	res.Groups = []int{arg.Gid}
+	return nil
+}
+
+func benchArg() *internalDropArg {
+	return &internalDropArg{
+		Uid:            1001,
+		Gid:            1001,
+		Groups:         []int{1001, 1002},
+		Umask:          intp(0o022),
+		ParentPid:      1,
+		AllowedMethods: []string{"S.A"},
+	}
+}
+
+// BenchmarkHandshake compares the handshake as an rpc call, with a
+// new connection and so new gob streams each time as with a new
+// child, against the frames sent now. It flatters the rpc call, as
+// gob's compiled types are reused across iterations but not across
+// children.
+func BenchmarkHandshake(b *testing.B) {
+	b.Run("rpc", func(b *testing.B) {
+		srv := rpc.NewServer()
+		if err := srv.RegisterName("Internal", benchService{}); err != nil {
+			b.Fatal(err)
+		}
+		arg := (*BenchDropArg)(benchArg())
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p, c := net.Pipe()
+			go srv.ServeConn(c)
+			cl := rpc.NewClient(p)
+			var res BenchDropResult
+			if err := cl.Call("Internal.Drop", arg, &res); err != nil {
+				b.Fatal(err)
+			}
+			cl.Close()
+		}
+	})
+	b.Run("frame", func(b *testing.B) {
+		arg := benchArg()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p, c := net.Pipe()
+			go func() {
+				defer c.Close()
+				var arg internalDropArg
+				if err := readFrame(c, arg.wire); err != nil {
+					return
+				}
+				var res internalDropResult
+				benchService{}.Drop((*BenchDropArg)(&arg), (*BenchDropResult)(&res))
+				var msg string
+				writeFrame(c, func(w *wire) {
+					w.string(&msg)
+					res.wire(w)
+				})
+			}()
+			var res internalDropResult
+			if err := handshake(p, arg, &res); err != nil {
+				b.Fatal(err)
+			}
+			p.Close()
+		}
+	})
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrTooManyChildren is returned when starting a child would exceed
+// the limit set by SetChildLimit and it was set not to wait.
+var ErrTooManyChildren = errors.New("runas: too many live children")
+
+var live struct {
+	mu    sync.Mutex
+	n     int           // children started and not yet reaped
+	max   int           // if positive, the limit on n
+	wait  bool          // whether to wait for n to drop below max
+	freed chan struct{} // closed, and replaced, when n drops
+
+	clients map[*Client]bool // started and not yet reaped
+}
+
+// SetChildLimit caps the number of live children, across all of
+// the package's ways of starting them, at max; zero or negative
+// means no cap, which is the default. A child counts until it has
+// exited and been reaped. Starting a child at the cap fails with
+// ErrTooManyChildren, or if wait is true, waits for one to be
+// reaped, giving up if the context passed in is done first.
+// Lowering the cap doesn't affect children already running.
+func SetChildLimit(max int, wait bool) {
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	live.max = max
+	live.wait = wait
+	notifyFreed()
+}
+
+// LiveChildren returns the number of children started and not yet
+// reaped.
+func LiveChildren() int {
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	return live.n
+}
+
+// acquireChild counts a child about to be started, waiting or
+// failing if that would exceed the limit.
+func acquireChild(ctx context.Context) error {
+	for {
+		live.mu.Lock()
+		if live.max <= 0 || live.n < live.max {
+			live.n++
+			live.mu.Unlock()
+			return nil
+		}
+		if !live.wait {
+			live.mu.Unlock()
+			return ErrTooManyChildren
+		}
+		if live.freed == nil {
+			live.freed = make(chan struct{})
+		}
+		freed := live.freed
+		live.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// releaseChild uncounts a child that's been reaped, or that failed
+// to start.
+func releaseChild() {
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	live.n--
+	notifyFreed()
+}
+
+// notifyFreed wakes acquireChild callers waiting for a slot.
+// live.mu must be held.
+func notifyFreed() {
+	if live.freed != nil {
+		close(live.freed)
+		live.freed = nil
+	}
+}
+
+// trackClient and untrackClient keep the set of clients whose
+// children KillChildren kills and ListChildren lists.
+func trackClient(c *Client) {
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	if live.clients == nil {
+		live.clients = make(map[*Client]bool)
+	}
+	live.clients[c] = true
+}
+
+func untrackClient(c *Client) {
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	delete(live.clients, c)
+}
+
+// ChildInfo describes a live child, for ListChildren.
+type ChildInfo struct {
+	Pid      int
+	Uid, Gid int       // what it dropped, or is dropping, to
+	Started  time.Time // when it was started
+}
+
+// ListChildren returns the children started and not yet reaped, in
+// the order they were started, such as for a debugging page.
+func ListChildren() []ChildInfo {
+	live.mu.Lock()
+	infos := make([]ChildInfo, 0, len(live.clients))
+	for c := range live.clients {
+		infos = append(infos, ChildInfo{Pid: c.Pid(), Uid: c.uid, Gid: c.gid, Started: c.started})
+	}
+	live.mu.Unlock()
+	slices.SortFunc(infos, func(a, b ChildInfo) int {
+		return a.Started.Compare(b.Started)
+	})
+	return infos
+}
+
+// KillChildren kills every live child, as Client.Close would but
+// without waiting, for a parent that's about to exit without closing
+// its Clients. Children left behind are mostly harmless, since they
+// exit once they see the parent's end of the connection close, but
+// one busy in a call keeps running until the call returns.
+//
+// On Linux, children are also killed by the kernel if the parent
+// dies, however it dies, so this is only needed elsewhere or for
+// grandchildren a child started in its own process group (see
+// Config.Setpgid).
+func KillChildren() {
+	live.mu.Lock()
+	clients := make([]*Client, 0, len(live.clients))
+	for c := range live.clients {
+		clients = append(clients, c)
+	}
+	live.mu.Unlock()
+	for _, c := range clients {
+		c.kill()
+	}
+}
+
+// KillChildrenOnSignal arranges for the first of sigs the parent
+// receives, by default SIGINT or SIGTERM, to call KillChildren and
+// then have its usual effect, normally killing the parent. Programs
+// that handle those signals themselves should call KillChildren
+// from their handler instead.
+func KillChildrenOnSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, sigs...)
+	go func() {
+		sig := <-sigc
+		KillChildren()
+		signal.Reset(sigs...)
+		if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(sig) == nil {
+			return
+		}
+		os.Exit(1)
+	}()
+}
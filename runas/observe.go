@@ -0,0 +1,81 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// Observer is told about children as they come and go, for metrics.
+// Its methods are called synchronously, possibly concurrently, so
+// they should be quick and safe for concurrent use.
+type Observer interface {
+	// OnSpawn is called once a child process has started, before
+	// it has dropped privileges.
+	OnSpawn(pid, uid, gid int)
+
+	// OnDropFailure is called when a started child fails to drop
+	// privileges, or doesn't in time, and is killed. err is the
+	// error the caller gets; handshake timeouts match
+	// ErrHandshakeTimeout with errors.Is.
+	OnDropFailure(uid, gid int, err error)
+
+	// OnChildExit is called once each child has exited and been
+	// reaped, for whatever reason. state is nil if it couldn't be
+	// waited for.
+	OnChildExit(pid int, state *os.ProcessState)
+}
+
+// RestartObserver is an Observer that's also told when a Pool
+// replaces a child that died or stopped answering.
+type RestartObserver interface {
+	Observer
+	OnRestart(uid, gid int)
+}
+
+// IdleObserver is an Observer that's also told when a Pool drains
+// a child for being idle; see Pool.IdleTimeout.
+type IdleObserver interface {
+	Observer
+	OnIdleEvict(uid, gid int)
+}
+
+var observer atomic.Pointer[Observer]
+
+// SetObserver makes o the Observer for all children started after
+// it's called. A nil o restores the default, which does nothing.
+func SetObserver(o Observer) {
+	if o == nil {
+		observer.Store(nil)
+		return
+	}
+	observer.Store(&o)
+}
+
+func getObserver() Observer {
+	if p := observer.Load(); p != nil {
+		return *p
+	}
+	return nopObserver{}
+}
+
+type nopObserver struct{}
+
+func (nopObserver) OnSpawn(pid, uid, gid int)                   {}
+func (nopObserver) OnDropFailure(uid, gid int, err error)       {}
+func (nopObserver) OnChildExit(pid int, state *os.ProcessState) {}
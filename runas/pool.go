@@ -0,0 +1,377 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrPoolFull is returned by Pool.Get when starting another child
+// would exceed the Pool's MaxChildren.
+var ErrPoolFull = errors.New("runas: pool has reached MaxChildren")
+
+// ErrPoolClosed is returned by Pool.Get after the Pool is closed.
+var ErrPoolClosed = errors.New("runas: pool is closed")
+
+// Pool caches live children per uid and gid, by default one each,
+// so repeated calls for the same user share a child process.
+// Children are started on demand and restarted if they die, stop
+// answering Ping, or their Client is closed.
+//
+// A Pool is safe for concurrent use. The zero value is ready to use.
+type Pool struct {
+	// Config, if non-nil, is used to start children.
+	Config *Config
+
+	// MaxChildren, if positive, bounds the number of live children
+	// the Pool runs at once.
+	MaxChildren int
+
+	// ChildrenPerUser, if greater than one, is how many children
+	// the Pool runs for each uid and gid. Get hands them out in
+	// turn, so that concurrent calls for one user aren't all
+	// serialized through one child.
+	ChildrenPerUser int
+
+	// CallRetries bounds how many times Call retries a call with a
+	// new child after losing the old one. Zero means once; negative
+	// means never.
+	CallRetries int
+
+	// IdleTimeout, if positive, is how long a child can go without
+	// being handed out by Get before the Pool drains it, as
+	// Client.Drain does, to start a new one when next needed. It
+	// trades the cost of starting children for that of keeping
+	// idle ones. An IdleObserver is told of each.
+	IdleTimeout time.Duration
+
+	// KeepaliveInterval, if positive, is how often the Pool pings
+	// each of its children in the background, so that one that's
+	// stopped answering is replaced before a caller finds out.
+	KeepaliveInterval time.Duration
+
+	mu       sync.Mutex
+	closed   bool
+	children map[poolKey]*poolEntry
+	next     map[poolKey]int // keyed with slot 0: the slot Get hands out next
+	sweeping bool            // whether the sweep goroutine is running
+}
+
+type poolKey struct {
+	uid, gid int
+	slot     int // which of ChildrenPerUser
+}
+
+type poolEntry struct {
+	ready chan struct{} // closed once c or err is set
+	c     *Client
+	err   error
+
+	lastUsed time.Time // when Get last handed out c; guarded by Pool.mu
+	lastPing time.Time // when sweep last pinged c; only sweep uses it
+}
+
+func (p *Pool) config() *Config {
+	if p.Config != nil {
+		return p.Config
+	}
+	return new(Config)
+}
+
+// Get returns a Client for a child running as username, starting
+// one if there isn't a live one already. An existing child is only
+// checked to be running, with its connection intact, not pinged, so
+// that Get costs no round trip and a busy child isn't mistaken for
+// a dead one; see KeepaliveInterval for catching children that have
+// stopped answering. The Client is shared with other callers of
+// Get; closing it makes the Pool start a new child next time.
+func (p *Pool) Get(username string) (*Client, error) {
+	arg, u, err := lookupUser(username)
+	if err != nil {
+		return nil, err
+	}
+	k := p.nextKey(arg.Uid, arg.Gid)
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		e, ok := p.children[k]
+		if !ok {
+			if p.MaxChildren > 0 && len(p.children) >= p.MaxChildren {
+				p.mu.Unlock()
+				return nil, ErrPoolFull
+			}
+			e = &poolEntry{ready: make(chan struct{}), lastUsed: time.Now()}
+			if p.children == nil {
+				p.children = make(map[poolKey]*poolEntry)
+			}
+			p.children[k] = e
+			if !p.sweeping && (p.IdleTimeout > 0 || p.KeepaliveInterval > 0) {
+				p.sweeping = true
+				go p.sweep()
+			}
+			p.mu.Unlock()
+
+			e.c, e.err = p.config().spawn(context.Background(), arg, u)
+			close(e.ready)
+			if e.err != nil {
+				p.remove(k, e)
+				return nil, e.err
+			}
+			return e.c, nil
+		}
+		p.mu.Unlock()
+
+		<-e.ready
+		if e.err == nil && e.c.alive() {
+			p.mu.Lock()
+			e.lastUsed = time.Now()
+			p.mu.Unlock()
+			return e.c, nil
+		}
+		if p.remove(k, e) && e.err == nil {
+			// It was running, and the next time round replaces it.
+			if o, ok := getObserver().(RestartObserver); ok {
+				o.OnRestart(arg.Uid, arg.Gid)
+			}
+		}
+	}
+}
+
+// Call calls serviceMethod in a child running as username, like
+// Client.Call, so callers needn't check for dead children
+// themselves. If the child dies or its connection breaks during the
+// call, or it's being drained for being idle, Call starts a new
+// child and tries again, up to CallRetries times, so methods called
+// this way should be safe to repeat. Errors the method returns,
+// failures to start a child, and failures to drop privileges aren't
+// retried; see IsConnectionError.
+func (p *Pool) Call(username, serviceMethod string, args, reply any) error {
+	for try := 0; ; try++ {
+		c, err := p.Get(username)
+		if err != nil {
+			return err
+		}
+		err = c.Call(serviceMethod, args, reply)
+		if !IsConnectionError(err) || try >= p.callRetries() {
+			return err
+		}
+		if errors.Is(err, ErrDraining) {
+			// The Pool has already let go of c, and closing it
+			// would cut off the calls Drain is waiting for.
+			continue
+		}
+		// So that Get doesn't hand it out again.
+		c.Close()
+	}
+}
+
+func (p *Pool) callRetries() int {
+	if p.CallRetries == 0 {
+		return 1
+	}
+	return max(p.CallRetries, 0)
+}
+
+// IsConnectionError reports whether err, from a call to a child,
+// means the connection to the child was lost, or the Client is
+// draining, rather than the method returning an error, which
+// arrives as an rpc.ServerError. Only the former are worth retrying
+// with another child, as Pool.Call does. A child that's killed can
+// show up as any of these, depending on the transport and on what
+// the connection was doing at the time.
+func IsConnectionError(err error) bool {
+	for _, target := range connectionErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+var connectionErrors = []error{
+	rpc.ErrShutdown,
+	io.EOF,
+	io.ErrUnexpectedEOF,
+	ErrDraining,
+	syscall.ECONNRESET,
+	syscall.EPIPE,
+	net.ErrClosed,
+	os.ErrClosed,
+}
+
+// nextKey returns the key of the child Get should hand out next for
+// uid and gid.
+func (p *Pool) nextKey(uid, gid int) poolKey {
+	k := poolKey{uid: uid, gid: gid}
+	if p.ChildrenPerUser <= 1 {
+		return k
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next == nil {
+		p.next = make(map[poolKey]int)
+	}
+	slot := p.next[k]
+	p.next[k] = (slot + 1) % p.ChildrenPerUser
+	k.slot = slot
+	return k
+}
+
+// ping checks that c still answers, giving it as long as a new
+// child would get to start. A child that's too slow is killed.
+func (p *Pool) ping(c *Client) error {
+	ctx := context.Background()
+	if d := p.config().handshakeTimeout(); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return c.ping(ctx)
+}
+
+// sweep drains idle children and pings the rest, as configured by
+// IdleTimeout and KeepaliveInterval, until the Pool is closed.
+func (p *Pool) sweep() {
+	interval := p.KeepaliveInterval
+	if d := p.IdleTimeout / 2; d > 0 && (interval <= 0 || d < interval) {
+		interval = d
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		now := time.Now()
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		var idle, ping []poolKey
+		entries := make(map[poolKey]*poolEntry)
+		for k, e := range p.children {
+			select {
+			case <-e.ready:
+			default:
+				continue // still starting
+			}
+			if e.c == nil {
+				continue
+			}
+			entries[k] = e
+			if p.IdleTimeout > 0 && now.Sub(e.lastUsed) >= p.IdleTimeout {
+				idle = append(idle, k)
+			} else if p.KeepaliveInterval > 0 && now.Sub(e.lastPing) >= p.KeepaliveInterval {
+				ping = append(ping, k)
+			}
+		}
+		for _, k := range idle {
+			delete(p.children, k)
+		}
+		p.mu.Unlock()
+
+		for _, k := range idle {
+			go entries[k].c.Drain(context.Background())
+			if o, ok := getObserver().(IdleObserver); ok {
+				o.OnIdleEvict(k.uid, k.gid)
+			}
+		}
+		for _, k := range ping {
+			e := entries[k]
+			e.lastPing = now
+			if p.ping(e.c) != nil {
+				p.remove(k, e)
+			}
+		}
+	}
+}
+
+// remove forgets e, if it's still the entry for k, and cleans up
+// after its child. It reports whether e was forgotten by this call.
+func (p *Pool) remove(k poolKey, e *poolEntry) bool {
+	p.mu.Lock()
+	removed := p.children[k] == e
+	if removed {
+		delete(p.children, k)
+	}
+	p.mu.Unlock()
+	if e.c != nil {
+		e.c.Close()
+	}
+	return removed
+}
+
+// Close closes all of the Pool's children, returning the first
+// error encountered. Later calls to Get fail with ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	children := p.children
+	p.children = nil
+	p.mu.Unlock()
+
+	var err error
+	for _, e := range children {
+		<-e.ready
+		if e.c == nil {
+			continue
+		}
+		if cerr := e.c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Drain is like Close but drains each child, as Client.Drain does,
+// rather than closing it: calls in flight are given until ctx is
+// done to finish. It returns the first error encountered.
+func (p *Pool) Drain(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	children := p.children
+	p.children = nil
+	p.mu.Unlock()
+
+	errc := make(chan error, len(children))
+	for _, e := range children {
+		go func(e *poolEntry) {
+			<-e.ready
+			if e.c == nil {
+				errc <- nil
+				return
+			}
+			errc <- e.c.Drain(ctx)
+		}(e)
+	}
+	var err error
+	for range children {
+		if derr := <-errc; derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return err
+}
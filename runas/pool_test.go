@@ -0,0 +1,54 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{rpc.ServerError("EOF"), false},
+		{errors.New("runas: something else"), false},
+		{rpc.ErrShutdown, true},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{ErrDraining, true},
+		{fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), true},
+		{&net.OpError{Op: "read", Net: "unix", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{&os.PathError{Op: "read", Path: "runas-socket", Err: syscall.ECONNRESET}, true},
+		{&os.PathError{Op: "write", Path: "|1", Err: syscall.EPIPE}, true},
+		{&net.OpError{Op: "write", Net: "unix", Err: net.ErrClosed}, true},
+		{&os.PathError{Op: "read", Path: "|0", Err: os.ErrClosed}, true},
+	}
+	for _, tt := range tests {
+		if got := IsConnectionError(tt.err); got != tt.want {
+			t.Errorf("IsConnectionError(%#v) = %v; want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotReady is returned when a child doesn't become ready within
+// the Config's ReadyTimeout.
+var ErrNotReady = errors.New("runas: timed out waiting for child to become ready")
+
+var readyWG sync.WaitGroup
+
+// DelayReady, called in a child before MaybeRunChildServer, holds
+// off its readiness until the returned function is called, for a
+// child that finishes setting up in the background, such as by
+// registering services as plugins load. A parent whose Config sets
+// ReadyTimeout waits for every such function to be called before
+// handing out the Client; other parents don't wait. The function may
+// be called more than once.
+func DelayReady() (ready func()) {
+	readyWG.Add(1)
+	return sync.OnceFunc(readyWG.Done)
+}
+
+// Ready replies once the child is ready, for Config.ReadyTimeout.
+func (s *internalService) Ready(arg bool, reply *bool) error {
+	readyWG.Wait()
+	*reply = true
+	return nil
+}
+
+// waitReady waits up to d for the child to become ready, or until
+// ctx is done.
+func (c *Client) waitReady(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	var ok bool
+	select {
+	case call := <-c.Go("InternalGoRunAs.Ready", true, &ok, nil).Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return ErrNotReady
+	}
+}
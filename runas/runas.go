@@ -19,31 +19,99 @@ limitations under the License.
 package runas
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/rpc"
 	"os"
-	"os/exec"
-	"os/user"
 	"path/filepath"
 	"strconv"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var _ = log.Printf
-
 // Server is the RPC server that is run in the child process.
 // Services needed to be exported on Server before
 // runas.MaybeRunChildServer() is called, typically early in your main
-// package's main().
+// package's main(). In a child, MaybeRunChildServer doesn't return,
+// so anything registered later never is; see RegisterService for
+// services added to a running child. The service name
+// InternalServiceName is taken; registering another service under
+// it fails with rpc's "service already defined" error.
 var Server = rpc.NewServer()
 
+// InternalServiceName is the name of the package's own service,
+// which every server it creates has registered and which parent and
+// child use to manage each other. It's reserved: no other service
+// may be registered under it.
+const InternalServiceName = "InternalGoRunAs"
+
+// ChildEnvVar is the environment variable that marks a process as a
+// child, for MaybeRunChildServer. A program can change it so as not
+// to collide with something else using the same mechanism, or to
+// tell one layer of nested children from another, but parent and
+// child must agree: change it before MaybeRunChildServer is called,
+// and before any child is started.
+var ChildEnvVar = "BECOME_GO_RUNAS_CHILD"
+
+var (
+	serversMu sync.Mutex
+	servers   = map[string]*rpc.Server{} // by name, from NewServer
+)
+
+// NewServer returns a new RPC server, separate from Server, that a
+// child can be asked to run instead via Config.Server. Like Server,
+// it must have its services registered before MaybeRunChildServer
+// is called, and InternalServiceName is taken on it too. The name
+// identifies the server to the child, so it must be unique and the
+// same in parent and child.
+func NewServer(name string) *rpc.Server {
+	if name == "" {
+		panic("runas: NewServer with empty name")
+	}
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	if _, dup := servers[name]; dup {
+		panic("runas: NewServer called twice for " + name)
+	}
+	s := rpc.NewServer()
+	s.RegisterName(InternalServiceName, &internalService{server: s})
+	servers[name] = s
+	return s
+}
+
+// serverName returns the name s was created with by NewServer, or
+// "" for Server.
+func serverName(s *rpc.Server) (string, error) {
+	if s == nil || s == Server {
+		return "", nil
+	}
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	for name, ns := range servers {
+		if ns == s {
+			return name, nil
+		}
+	}
+	return "", errors.New("runas: Config.Server wasn't created by NewServer")
+}
+
 type splitReadWrite struct {
 	io.Reader
 	io.Writer
 }
 
+// CloseWrite closes only the Writer, as a socket's CloseWrite shuts
+// down only its sending side.
+func (s *splitReadWrite) CloseWrite() error {
+	if c, ok := s.Writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func (s *splitReadWrite) Close() error {
 	if c, ok := s.Reader.(io.Closer); ok {
 		c.Close()
@@ -54,96 +122,364 @@ func (s *splitReadWrite) Close() error {
 	return nil
 }
 
-var doneInit = false
+var (
+	doneInit = false
 
-// MaybeRunChildServer does nothing in your parent process but
-// takes over the process in the child process to run the
-// root-dropping RPC server.
-func MaybeRunChildServer() {
-	doneInit = true
-	if os.Getenv("BECOME_GO_RUNAS_CHILD") != "1" {
-		return
+	// servingChild is whether ServeChild found the process to be a
+	// child, for IsChild.
+	servingChild bool
+
+	// self is the absolute path of os.Args[0], resolved in
+	// MaybeRunChildServer before main has a chance to change
+	// directory, for systems where runningBinary can't tell.
+	self    string
+	selfErr error
+
+	inheritedFiles []*os.File // from the parent's Config.Files
+)
+
+// InheritedFiles returns, in a child, the files the parent passed
+// with Config.Files, in the same order. It returns nil in the parent
+// or if none were passed, and is only valid once
+// MaybeRunChildServer has been called.
+func InheritedFiles() []*os.File {
+	return inheritedFiles
+}
+
+// childConfig is the parent's Config.ChildConfig.
+var childConfig atomic.Pointer[[]byte]
+
+// ChildConfig returns, in a child, the parent's Config.ChildConfig,
+// or nil if it set none. It's set before the child drops
+// privileges, so it's there for setup steps (see RegisterSetup) as
+// well as every call. It returns nil in the parent.
+func ChildConfig() []byte {
+	if p := childConfig.Load(); p != nil {
+		return *p
 	}
-	Server.ServeConn(&splitReadWrite{os.Stdin, os.Stdout})
-	os.Exit(0)
+	return nil
 }
 
-// User returns an rpc Client suitable for talking to Server
-// running as the provided user.
-func User(username string) (*rpc.Client, error) {
-	u, err := user.Lookup(username)
+// MaybeRunChildServer does nothing in your parent process but
+// takes over the process in the child process to run the
+// root-dropping RPC server: Server, or the one created by NewServer
+// that the parent asked for. The child exits with status 0 once the
+// parent closes the connection, and with status 1, after saying why
+// on stderr, if it couldn't be set up or the connection broke, as
+// with a request it couldn't decode, so that the parent's
+// Client.Wait can tell the two apart.
+func MaybeRunChildServer() {
+	child, err := ServeChild()
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if child {
+		os.Exit(0)
 	}
-	uid, _ := strconv.Atoi(u.Uid)
-	gid, _ := strconv.Atoi(u.Gid)
-	return UidGid(uid, gid)
 }
 
-// UidGid returns an rpc Client suitable for talking to Server
-// running as the provided userid and group id.
-func UidGid(uid, gid int) (*rpc.Client, error) {
-	if !doneInit {
-		panic("runas.MaybeRunChildServer() never called")
+// ServeChild is like MaybeRunChildServer but returns in the child
+// too, once the parent has closed the connection, so that the
+// program can clean up and exit itself. It reports whether the
+// process is a child, returning false at once in the parent, and
+// any error setting up the child's server or, if the connection
+// ended other than by the parent closing it, why. A child that fails
+// to drop privileges still exits without returning.
+func ServeChild() (child bool, err error) {
+	doneInit = true
+	self, selfErr = filepath.Abs(os.Args[0])
+	servingChild = isChild()
+	if !servingChild {
+		return false, nil
 	}
-	binary, _ := filepath.Abs(os.Args[0])
-	cmd := exec.Command(binary)
-	cmd.Dir = "/"
-	cmd.Env = []string{"BECOME_GO_RUNAS_CHILD=1"}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		panic(err)
+	server := Server
+	if name := os.Getenv("BECOME_GO_RUNAS_SERVER"); name != "" {
+		serversMu.Lock()
+		server = servers[name]
+		serversMu.Unlock()
+		if server == nil {
+			return true, fmt.Errorf("runas: child has no server named %q", name)
+		}
+	}
+	if v := os.Getenv("BECOME_GO_RUNAS_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return true, fmt.Errorf("runas: bad BECOME_GO_RUNAS_FILES %q", v)
+		}
+		for i := 0; i < n; i++ {
+			// ExtraFiles start after stderr.
+			fd := 3 + i
+			inheritedFiles = append(inheritedFiles, os.NewFile(uintptr(fd), "runas-file-"+strconv.Itoa(fd)))
+		}
+	}
+	codec := GobCodec
+	if name := os.Getenv("BECOME_GO_RUNAS_CODEC"); name != "" {
+		if codec, err = parseCodec(name); err != nil {
+			return true, err
+		}
 	}
-	stdin, err := cmd.StdinPipe()
+	t, err := childTransport()
 	if err != nil {
-		panic(err)
+		return true, err
 	}
-	err = cmd.Start()
+	conn, err := t.Accept()
 	if err != nil {
-		panic(err.Error())
+		return true, err
 	}
-	c := rpc.NewClient(&splitReadWrite{stdout, stdin})
+	if err := serveHandshake(conn); err != nil {
+		if err == io.EOF {
+			// The parent went away before asking anything.
+			return true, nil
+		}
+		return true, err
+	}
+	if err := serveCodec(server, codec.serverCodec(conn)); err != nil {
+		return true, fmt.Errorf("runas: child's connection to parent broke: %w", err)
+	}
+	return true, nil
+}
 
-	// These are embedded in structs and named with a capital R to make
-	// reflect & rpc happy. That way we don't have to export them
-	// in our go doc.
-	var res struct{ R internalDropResult }
-	var req struct{ R internalDropArg }
-	req.R.Uid = uid
-	req.R.Gid = gid
-	err = c.Call("InternalGoRunAs.DropPrivileges", &req, &res)
-	if res.R.UidDropped != true || res.R.GidDropped != true {
-		return nil, fmt.Errorf("runas: failed to drop root to %d/%d: %v", uid, gid, res)
+// IsChild reports whether the process is a runas child, for code
+// that runs in both parent and child but should behave differently
+// in each. Once MaybeRunChildServer or ServeChild has been called,
+// it reports what they found, whatever has happened to ChildEnvVar
+// or the environment since; before that, it goes by the
+// environment, as they would.
+func IsChild() bool {
+	if doneInit {
+		return servingChild
 	}
-	return c, nil
+	return isChild()
+}
+
+// User returns a Client suitable for talking to Server
+// running as the provided user.
+func User(username string) (*Client, error) {
+	return UserContext(context.Background(), username)
+}
+
+// UserContext is like User but gives up, killing the child, if ctx
+// is done before the child has dropped privileges.
+func UserContext(ctx context.Context, username string) (*Client, error) {
+	return new(Config).User(ctx, username)
+}
+
+// Uid returns a Client suitable for talking to Server running as
+// the provided userid, with the primary and supplementary groups
+// of its passwd entry. It's an error if uid has no passwd entry.
+func Uid(uid int) (*Client, error) {
+	return new(Config).Uid(context.Background(), uid)
+}
+
+// UserGroup is like User but runs with groupname as the primary
+// group instead of the user's login group. groupname is also added
+// to the user's supplementary groups.
+func UserGroup(username, groupname string) (*Client, error) {
+	return new(Config).UserGroup(context.Background(), username, groupname)
+}
+
+// UidGid returns a Client suitable for talking to Server
+// running as the provided userid and group id, with gid as its only
+// group; see Config.InitGroups to also set uid's groups. The caller
+// should Close the Client when done with it to reap the child.
+func UidGid(uid, gid int) (*Client, error) {
+	return UidGidContext(context.Background(), uid, gid)
+}
+
+// UidGidContext is like UidGid but gives up, killing the child, if
+// ctx is done before the child has dropped privileges. Once a Client
+// is returned, ctx no longer affects it.
+func UidGidContext(ctx context.Context, uid, gid int) (*Client, error) {
+	return new(Config).UidGid(ctx, uid, gid)
+}
+
+// DropTo is for a user as written in config files and flags: either
+// a username, as for User, or numeric ids as "uid:gid", as for
+// UidGid.
+func DropTo(spec string) (*Client, error) {
+	return new(Config).DropTo(context.Background(), spec)
+}
+
+// DropToNobody returns a Client for a child running as the least
+// privileged account there is: the nobody user, with its login group
+// as its only group, whatever the system calls that group, or uid
+// and gid 65534 if there's no nobody user.
+func DropToNobody() (*Client, error) {
+	return new(Config).Nobody(context.Background())
+}
+
+// UidGidChroot is like UidGid but confines the child to dir with
+// chroot(2) before dropping privileges.
+func UidGidChroot(uid, gid int, dir string) (*Client, error) {
+	if dir == "" {
+		return nil, errors.New("runas: empty chroot directory")
+	}
+	return (&Config{Chroot: dir}).UidGid(context.Background(), uid, gid)
 }
 
 type internalService struct {
+	server *rpc.Server // the server it's registered on
 }
 
 type internalDropArg struct {
 	Uid, Gid int
+
+	// Groups is the supplementary group list to set before
+	// dropping. If nil, it's just Gid.
+	Groups []int
+
+	// Chroot, if non-empty, is the directory to chroot into
+	// before dropping.
+	Chroot string
+
+	// Setup, if non-empty, names the child's registered setup step
+	// to run before chrooting.
+	Setup string
+
+	// MountNamespace is whether the child is in a new mount
+	// namespace, whose mounts it makes private before Setup.
+	MountNamespace bool
+
+	// ReadOnlyRoot is whether to remount the root, or Chroot,
+	// read-only after Setup.
+	ReadOnlyRoot bool
+
+	// WorkingDir, if non-empty, is changed to after dropping.
+	WorkingDir string
+
+	// Umask, if non-nil, is set after dropping.
+	Umask *int
+
+	// OomScoreAdj, if non-nil, is set before dropping.
+	OomScoreAdj *int
+
+	// CPUAffinity, if non-empty, is set before dropping.
+	CPUAffinity []int
+
+	// Nice, if non-nil, is set before dropping.
+	Nice *int
+
+	// Rlimits are set after dropping.
+	Rlimits []Rlimit
+
+	// DisableCoreDumps is whether to disable core dumps after
+	// dropping.
+	DisableCoreDumps bool
+
+	// NoNewPrivs is whether to set no_new_privs after dropping.
+	NoNewPrivs bool
+
+	// SeccompFilter, if non-empty, names the child's registered
+	// seccomp filter to install last.
+	SeccompFilter string
+
+	// Capabilities, if non-nil, are the capability numbers to
+	// keep across setuid.
+	Capabilities []int
+
+	// ProcessName, if non-empty, is set as the process name first.
+	ProcessName string
+
+	// EffectiveOnly is whether to change only the effective ids.
+	EffectiveOnly bool
+
+	// SetgroupsDenied is whether the child is in a user namespace
+	// where the kernel forbids setgroups.
+	SetgroupsDenied bool
+
+	// ParentPid is the parent's process id, for checking that it
+	// hasn't died while the child was dropping.
+	ParentPid int
+
+	// AllowedMethods, if non-empty and sorted, are the only methods
+	// served after the drop.
+	AllowedMethods []string
+
+	// ChildConfig is the parent's Config.ChildConfig.
+	ChildConfig []byte
+
+	// MaxCallDuration, if positive, bounds each call served after
+	// the drop.
+	MaxCallDuration time.Duration
+
+	// RefuseInternal is whether the child refuses the package's own
+	// methods, but for alwaysAllowed, for Config.Conn.
+	RefuseInternal bool
 }
 
 type internalDropResult struct {
 	UidDropped, GidDropped   bool
 	SetuidErrno, SetgidErrno uintptr
+
+	GroupsSet      bool
+	SetgroupsErrno uintptr
+
+	// GroupsKept reports that setgroups was skipped, as it may be
+	// when the child can't change its groups and needn't.
+	GroupsKept bool
+
+	// Groups are the child's supplementary groups, as read back
+	// right after dropping.
+	Groups []int
+
+	// StartEuid, Caps, CapsKnown and SeccompMode describe the child
+	// just before it changed ids, for explaining failures: its euid,
+	// its effective capabilities if known (Linux only), and its
+	// seccomp mode (-1 if unknown, 2 for a filter).
+	StartEuid   int
+	Caps        uint64
+	CapsKnown   bool
+	SeccompMode int
+
+	// Mechanism names the syscalls used to drop: "setresuid",
+	// "setuid" or "seteuid".
+	Mechanism string
+
+	// Uid, Euid, Gid and Egid are the child's ids as read back
+	// right after dropping.
+	Uid, Euid, Gid, Egid int
+
+	// RegainRefused reports whether, after dropping, an attempt to
+	// switch back to uid 0 failed with EPERM as it should.
+	RegainRefused bool
+
+	// RlimitErrnos has an entry for each of the argument's Rlimits,
+	// zero if it was set.
+	RlimitErrnos []uintptr
+
+	// AllowedMethods is what the child restricted itself to, for
+	// checking against the argument's.
+	AllowedMethods []string
+
+	// NoNewPrivsErrno is why no_new_privs couldn't be set, if it
+	// was asked for.
+	NoNewPrivsErrno uintptr
+
+	// CoreDumpsErrno is why core dumps couldn't be disabled, if
+	// that was asked for.
+	CoreDumpsErrno uintptr
+
+	// OomScoreAdjErrno is why oom_score_adj couldn't be set, if it
+	// was asked for.
+	OomScoreAdjErrno uintptr
+
+	// CPUAffinityErrno is why the CPU affinity couldn't be set, if
+	// it was asked for.
+	CPUAffinityErrno uintptr
+
+	// NiceErrno is why the nice value couldn't be set, if it was
+	// asked for, and Nice is what it is after dropping.
+	NiceErrno uintptr
+	Nice      int
 }
 
-func (s *internalService) DropPrivileges(arg *struct{ R internalDropArg }, result *struct{ R internalDropResult }) error {
-	if rv := syscall.Setgid(arg.R.Gid); rv != nil {
-		result.R.SetgidErrno = uintptr(rv.(syscall.Errno))
-	} else {
-		result.R.GidDropped = true
-	}
-	if rv := syscall.Setuid(arg.R.Uid); rv != nil {
-		result.R.SetuidErrno = uintptr(rv.(syscall.Errno))
-	} else {
-		result.R.UidDropped = true
-	}
+// Ping replies immediately, for Ping.
+func (s *internalService) Ping(arg bool, reply *bool) error {
+	*reply = arg
 	return nil
 }
 
 func init() {
-	Server.RegisterName("InternalGoRunAs", &internalService{})
+	Server.RegisterName(InternalServiceName, &internalService{server: Server})
 }
@@ -0,0 +1,231 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func init() {
+	// Fails uname(2) with EPERM and allows everything else.
+	RegisterSeccompFilter("test-deny-uname", []BPFInstruction{
+		{Code: 0x20, K: 0},                                  // ld [nr]
+		{Code: 0x15, Jf: 1, K: syscall.SYS_UNAME},           // jeq uname
+		{Code: 0x06, K: 0x00050000 | uint32(syscall.EPERM)}, // ret ERRNO
+		{Code: 0x06, K: 0x7fff0000},                         // ret ALLOW
+	})
+}
+
+// Uname replies with uname(2)'s errno.
+func (TestService) Uname(arg bool, errno *int) error {
+	var u syscall.Utsname
+	if err := syscall.Uname(&u); err != nil {
+		*errno = int(err.(syscall.Errno))
+	}
+	return nil
+}
+
+// Ids replies with the child's real, effective, saved and filesystem
+// uids and then gids, from /proc/self/status.
+func (TestService) Ids(arg bool, ids *[]string) error {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if v, ok := strings.CutPrefix(line, "Uid:"); ok {
+			*ids = append(*ids, strings.Fields(v)...)
+		}
+		if v, ok := strings.CutPrefix(line, "Gid:"); ok {
+			*ids = append(*ids, strings.Fields(v)...)
+		}
+	}
+	return nil
+}
+
+// TestMechanism checks that the child drops with setresuid, saved
+// ids and all.
+func TestMechanism(t *testing.T) {
+	c := startChild(t, nil)
+	if got := c.Mechanism(); got != "setresuid" {
+		t.Errorf("Mechanism = %q; want setresuid", got)
+	}
+	var ids []string
+	if err := c.Call("TestService.Ids", true, &ids); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"65534", "65534", "65534", "65534", "65534", "65534", "65534", "65534"}
+	if !slices.Equal(ids, want) {
+		t.Errorf("child's uids and gids = %v; want all 65534", ids)
+	}
+}
+
+// childPids returns the pids of the test's children, zombies
+// included.
+func childPids(t *testing.T) []int {
+	t.Helper()
+	dirs, err := os.ReadDir("/proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pids []int
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + d.Name() + "/stat")
+		if err != nil {
+			continue // it's gone
+		}
+		// The comm field is parenthesized and may have spaces.
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) > 1 && fields[1] == strconv.Itoa(os.Getpid()) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// TestCloseReapsChild checks that once Close returns, the child is
+// neither running nor left a zombie.
+func TestCloseReapsChild(t *testing.T) {
+	needRoot(t)
+	before := childPids(t)
+	c := startChild(t, nil)
+	if n := len(childPids(t)); n != len(before)+1 {
+		t.Fatalf("%d children with the child running; want %d", n, len(before)+1)
+	}
+	pid := c.Pid()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := childPids(t); !slices.Equal(after, before) {
+		t.Errorf("children after Close = %v; want %v", after, before)
+	}
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("child %d still there after Close: kill = %v", pid, err)
+	}
+}
+
+// TestSeccompFilterAllThreads checks that the filter is in force on
+// whichever thread a call runs on, in a binary built with cgo or
+// without it.
+func TestSeccompFilterAllThreads(t *testing.T) {
+	c := startChild(t, &Config{SeccompFilter: "test-deny-uname"})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var errno int
+			if err := c.Call("TestService.Uname", true, &errno); err != nil {
+				t.Error(err)
+			} else if syscall.Errno(errno) != syscall.EPERM {
+				t.Errorf("uname in child: errno %d; want EPERM", errno)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// threadStatus returns field of /proc/self/task/*/status for each
+// of the process's threads.
+func threadStatus(field string) ([]string, error) {
+	ents, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+	var vals []string
+	for _, e := range ents {
+		status, err := os.ReadFile("/proc/self/task/" + e.Name() + "/status")
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			if v, ok := strings.CutPrefix(line, field+":"); ok {
+				vals = append(vals, strings.TrimSpace(v))
+			}
+		}
+	}
+	return vals, nil
+}
+
+// NoNewPrivs replies with the no_new_privs setting of each of the
+// child's threads.
+func (TestService) NoNewPrivs(arg bool, reply *[]string) error {
+	var err error
+	*reply, err = threadStatus("NoNewPrivs")
+	return err
+}
+
+func TestNoNewPrivsAllThreads(t *testing.T) {
+	c := startChild(t, &Config{NoNewPrivs: true})
+	var got []string
+	if err := c.Call("TestService.NoNewPrivs", true, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 {
+		t.Fatal("no threads")
+	}
+	for i, v := range got {
+		if v != "1" {
+			t.Errorf("thread %d of %d has NoNewPrivs %s", i, len(got), v)
+		}
+	}
+}
+
+// CapEff replies with the effective capabilities of each of the
+// child's threads, as /proc shows them.
+func (TestService) CapEff(arg bool, reply *[]string) error {
+	var err error
+	*reply, err = threadStatus("CapEff")
+	return err
+}
+
+// TestCapabilities checks that Capabilities are kept on every
+// thread in binaries built without cgo, and refused up front in
+// those built with it, as go test builds by default.
+func TestCapabilities(t *testing.T) {
+	needRoot(t)
+	conf := &Config{Capabilities: []string{"CAP_NET_BIND_SERVICE"}}
+	if checkCaps() != nil {
+		_, err := conf.UidGid(context.Background(), 65534, 65534)
+		if err == nil || !strings.Contains(err.Error(), "CGO_ENABLED=0") {
+			t.Fatalf("with cgo: err = %v; want one naming CGO_ENABLED=0", err)
+		}
+		return
+	}
+	c := startChild(t, conf)
+	var got []string
+	if err := c.Call("TestService.CapEff", true, &got); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range got {
+		if v != "0000000000000400" {
+			t.Errorf("thread %d of %d has CapEff %s; want only CAP_NET_BIND_SERVICE", i, len(got), v)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary serve as its own runas child.
+func TestMain(m *testing.M) {
+	if err := Server.Register(new(TestService)); err != nil {
+		panic(err)
+	}
+	RegisterService("TestAdded", func() any { return new(TestService) })
+	MaybeRunChildServer()
+	os.Exit(m.Run())
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	t.Cleanup(func() {
+		// So that the test can run again.
+		setupMu.Lock()
+		delete(setupFuncs, "test-twice")
+		setupMu.Unlock()
+		seccompMu.Lock()
+		delete(seccompFilters, "test-twice")
+		seccompMu.Unlock()
+	})
+	tests := map[string]func(){
+		"RegisterSetup": func() {
+			RegisterSetup("test-twice", func() error { return nil })
+		},
+		"RegisterSeccompFilter": func() {
+			RegisterSeccompFilter("test-twice", []BPFInstruction{{Code: 0x06, K: 0x7fff0000}})
+		},
+	}
+	for name, register := range tests {
+		register()
+		func() {
+			defer func() {
+				if e := recover(); e != "runas: "+name+" called twice for test-twice" {
+					t.Errorf("second %s: recovered %v", name, e)
+				}
+			}()
+			register()
+		}()
+	}
+}
+
+// TestService is served by the test binary running as a child.
+type TestService struct{}
+
+// StartGrandchild starts a process that inherits the child's stderr
+// and outlives it, replying with its pid.
+func (TestService) StartGrandchild(arg bool, pid *int) error {
+	cmd := exec.Command("/bin/sleep", "5")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	*pid = cmd.Process.Pid
+	return nil
+}
+
+// DieOnce kills the child, without replying, unless the file at path
+// exists, creating it first so that the next call succeeds.
+func (TestService) DieOnce(path string, ok *bool) error {
+	if _, err := os.Stat(path); err == nil {
+		*ok = true
+		return nil
+	}
+	if err := os.WriteFile(path, nil, 0o666); err != nil {
+		return err
+	}
+	p, _ := os.FindProcess(os.Getpid())
+	p.Kill()
+	select {}
+}
+
+// Root replies with the names in the child's root directory.
+func (TestService) Root(arg bool, names *[]string) error {
+	ents, err := os.ReadDir("/")
+	if err != nil {
+		return err
+	}
+	*names = []string{}
+	for _, e := range ents {
+		*names = append(*names, e.Name())
+	}
+	return nil
+}
+
+// Sleep sleeps for d before replying.
+func (TestService) Sleep(d time.Duration, ok *bool) error {
+	time.Sleep(d)
+	*ok = true
+	return nil
+}
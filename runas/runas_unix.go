@@ -0,0 +1,778 @@
+//go:build !windows
+
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func isChild() bool {
+	return os.Getenv(ChildEnvVar) == "1"
+}
+
+// spawn starts a child process as configured by c and has it drop
+// privileges as described by arg. u is the user being dropped to,
+// if known.
+func (c *Config) spawn(ctx context.Context, arg *internalDropArg, u *user.User) (*Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !doneInit {
+		return nil, errors.New("runas: MaybeRunChildServer or ServeChild never called")
+	}
+	if os.Geteuid() != 0 && !c.UserNamespace && (arg.Uid != os.Getuid() || arg.Gid != os.Getgid()) {
+		// Don't bother starting a child that's bound to fail.
+		return nil, fmt.Errorf("%w to drop to uid %d and gid %d", ErrNotRoot, arg.Uid, arg.Gid)
+	}
+	server, err := serverName(c.Server)
+	if err != nil {
+		return nil, err
+	}
+	binary := c.ChildBinary
+	if binary == "" {
+		binary = runningBinary()
+	}
+	if binary == "" {
+		if selfErr != nil {
+			return nil, fmt.Errorf("runas: failed to find child binary: %w", selfErr)
+		}
+		binary = self
+	}
+	arg.Chroot = c.Chroot
+	arg.Setup = c.Setup
+	arg.MaxCallDuration = c.MaxCallDuration
+	if c.Conn != nil {
+		if c.ReadyTimeout > 0 {
+			return nil, errors.New("runas: Config.ReadyTimeout can't be used with Config.Conn")
+		}
+		arg.RefuseInternal = !c.ConnInternal
+	}
+	arg.ChildConfig = c.ChildConfig
+	if len(c.AllowMethods) > 0 {
+		arg.AllowedMethods = slices.Clone(c.AllowMethods)
+		slices.Sort(arg.AllowedMethods)
+		arg.AllowedMethods = slices.Compact(arg.AllowedMethods)
+	}
+	arg.WorkingDir = c.WorkingDir
+	arg.Umask = c.Umask
+	arg.OomScoreAdj = c.OomScoreAdj
+	arg.CPUAffinity = c.CPUAffinity
+	arg.Nice = c.Nice
+	arg.Rlimits = c.Rlimits
+	arg.NoNewPrivs = c.NoNewPrivs
+	arg.DisableCoreDumps = c.DisableCoreDumps
+	arg.SeccompFilter = c.SeccompFilter
+	who := strconv.Itoa(arg.Uid)
+	if u != nil {
+		who = u.Username
+	}
+	if c.ProcessName != "" {
+		arg.ProcessName = strings.ReplaceAll(c.ProcessName, "%s", who)
+	}
+	if c.Capabilities != nil {
+		if c.EffectiveOnly {
+			return nil, errors.New("runas: Config.EffectiveOnly can't be combined with Capabilities")
+		}
+		if arg.Capabilities, err = parseCaps(c.Capabilities); err != nil {
+			return nil, err
+		}
+		if c.ChildBinary == "" {
+			// The child is this binary, so it would fail too.
+			if err := checkCaps(); err != nil {
+				return nil, fmt.Errorf("runas: %w", err)
+			}
+		}
+	}
+	arg.EffectiveOnly = c.EffectiveOnly
+	cmd := exec.Command(binary, c.ChildArgs...)
+	if c.ChildArgv0 != "" {
+		cmd.Args[0] = c.ChildArgv0
+	} else if c.ChildBinary == "" {
+		// As the program was run, not necessarily binary.
+		cmd.Args[0] = os.Args[0]
+	}
+	cmd.Dir = "/"
+	if cmd.Env, err = c.childEnv(u); err != nil {
+		return nil, err
+	}
+	if server != "" {
+		cmd.Env = append(cmd.Env, "BECOME_GO_RUNAS_SERVER="+server)
+	}
+	if c.Codec != GobCodec {
+		cmd.Env = append(cmd.Env, "BECOME_GO_RUNAS_CODEC="+c.Codec.String())
+	}
+	if len(c.Files) > 0 {
+		cmd.Env = append(cmd.Env, "BECOME_GO_RUNAS_FILES="+strconv.Itoa(len(c.Files)))
+		cmd.ExtraFiles = slices.Clip(c.Files)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: c.Setsid || c.Hardened || c.Detach}
+	// A session leader already leads its own process group, and
+	// can't be moved to another.
+	cmd.SysProcAttr.Setpgid = c.Setpgid && !cmd.SysProcAttr.Setsid
+	setParentDeathSignal(cmd.SysProcAttr)
+	if c.UserNamespace {
+		if err := setUserNamespace(cmd.SysProcAttr, c); err != nil {
+			return nil, err
+		}
+		arg.SetgroupsDenied = os.Geteuid() != 0
+	}
+	if c.MountNamespace {
+		if err := setMountNamespace(cmd.SysProcAttr); err != nil {
+			return nil, err
+		}
+		arg.MountNamespace = true
+	}
+	if c.ReadOnlyRoot {
+		if !c.MountNamespace {
+			return nil, errors.New("runas: Config.ReadOnlyRoot needs Config.MountNamespace")
+		}
+		arg.ReadOnlyRoot = true
+	}
+	arg.ParentPid = os.Getpid()
+	tname, t, err := c.transport(cmd)
+	if err != nil {
+		return nil, err
+	}
+	conn, childEnds, err := t.Connect(cmd)
+	if err != nil {
+		return nil, err
+	}
+	closeChildEnds := func() {
+		for _, f := range childEnds {
+			f.Close()
+		}
+	}
+	// The child can write before its pid is known for the label, so
+	// hold that back until then.
+	stderr := &stderrTail{w: c.Stderr, holding: c.LabelStderr}
+	cmd.Stderr = stderr
+	// A grandchild that inherits stderr can hold the pipe open long
+	// after the child exits; don't let it keep cmd.Wait, and so Close,
+	// waiting for EOF.
+	cmd.WaitDelay = stderrWaitDelay
+	extra := slices.Clone(cmd.ExtraFiles)
+	if c.PrepareCmd != nil {
+		c.PrepareCmd(cmd)
+	}
+	if c.Detach && isCharDevice(cmd.Stdin) {
+		cmd.Stdin = nil
+	}
+	if c.Hardened {
+		if err := checkNoInheritedFds(cmd, extra); err != nil {
+			closeChildEnds()
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := acquireChild(ctx); err != nil {
+		closeChildEnds()
+		conn.Close()
+		return nil, err
+	}
+	err = cmd.Start()
+	closeChildEnds()
+	if err != nil {
+		releaseChild()
+		conn.Close()
+		return nil, fmt.Errorf("runas: failed to start child %s: %w", binary, err)
+	}
+	cl := newClient(cmd, c, tname, conn, arg.Uid, arg.Gid)
+	if c.LabelStderr {
+		stderr.setLabel(fmt.Sprintf("%s[%d]: ", who, cl.Pid()))
+	}
+	cl.log.Debug("runas: child started", "pid", cl.Pid(), "uid", arg.Uid, "gid", arg.Gid)
+	cl.obs.OnSpawn(cl.Pid(), arg.Uid, arg.Gid)
+	ev := AuditEvent{
+		ParentUid: os.Getuid(),
+		Pid:       cl.Pid(),
+		Uid:       arg.Uid,
+		Gid:       arg.Gid,
+		Groups:    groupList(arg.Gid, arg.Groups),
+
+		EffectiveOnly: arg.EffectiveOnly,
+	}
+	if u != nil {
+		ev.Username = u.Username
+	}
+	dropFailed := func(err error) (*Client, error) {
+		cl.Close()
+		err = stderr.annotate(err)
+		ev.Err = err
+		audit(ev)
+		cl.log.Warn("runas: child failed to drop privileges", "pid", cl.Pid(), "uid", arg.Uid, "gid", arg.Gid, "err", err)
+		cl.obs.OnDropFailure(arg.Uid, arg.Gid, err)
+		return nil, err
+	}
+
+	var res internalDropResult
+	var timeout <-chan time.Time
+	if d := c.handshakeTimeout(); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	done := make(chan error, 1)
+	go func() { done <- handshake(conn, arg, &res) }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		cl.Close()
+		ev.Err = ctx.Err()
+		audit(ev)
+		return nil, ctx.Err()
+	case <-timeout:
+		return dropFailed(ErrHandshakeTimeout)
+	}
+	if err != nil {
+		return dropFailed(&DropError{Uid: arg.Uid, Gid: arg.Gid, Err: err})
+	}
+	if err := res.failure(arg); err != nil {
+		return dropFailed(&DropError{
+			Uid:            arg.Uid,
+			Gid:            arg.Gid,
+			GroupsSet:      res.GroupsSet,
+			GidDropped:     res.GidDropped,
+			UidDropped:     res.UidDropped,
+			SetgroupsErrno: syscall.Errno(res.SetgroupsErrno),
+			SetuidErrno:    syscall.Errno(res.SetuidErrno),
+			SetgidErrno:    syscall.Errno(res.SetgidErrno),
+			Err:            err,
+		})
+	}
+	cl.rlimitErrs = res.rlimitErrors(arg)
+	cl.mechanism = res.Mechanism
+	if c.Conn != nil {
+		cl.startRelay(c.Conn)
+	} else {
+		cl.startRPC()
+	}
+	cl.log.Debug("runas: child dropped privileges", "pid", cl.Pid(), "uid", arg.Uid, "gid", arg.Gid, "mechanism", res.Mechanism)
+	audit(ev)
+	if d := c.ReadyTimeout; d > 0 {
+		if err := cl.waitReady(ctx, d); err != nil {
+			cl.Close()
+			return nil, stderr.annotate(err)
+		}
+	}
+	return cl, nil
+}
+
+// kill kills the child. With Config.Setpgid, the rest of its process
+// group is killed by killGroupOnExit once the child has exited, or,
+// where the system can't wait for that without reaping it, here.
+func (c *Client) kill() {
+	if !canWaitNoReap {
+		c.killProcessGroup()
+	}
+	c.cmd.Process.Kill()
+}
+
+// killProcessGroup kills the child's process group, if it leads its
+// own, unless the child has been reaped: after that, its pid, which
+// is the group's id, may have been reused by an unrelated process.
+// That can't be ruled out while racing the reaping, so it's only
+// for systems without canWaitNoReap.
+func (c *Client) killProcessGroup() {
+	select {
+	case <-c.exited:
+		return
+	default:
+	}
+	if c.killGroup {
+		syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// killGroupOnExit waits for the child to exit, without reaping it,
+// and then, if it leads its own process group, kills the rest of the
+// group, however the child exited. Until it's reaped, the child's
+// pid, and so the group's id, can't be reused. Without
+// canWaitNoReap it returns at once.
+func (c *Client) killGroupOnExit() {
+	if c.killGroup && canWaitNoReap && waitNoReap(c.cmd.Process.Pid) == nil {
+		syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+func socketpair() (*os.File, *os.File, error) {
+	// Hold ForkLock so that no child is started between creating
+	// the sockets and marking them close-on-exec, as package os
+	// does for systems without SOCK_CLOEXEC.
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), "runas-socket"), os.NewFile(uintptr(fds[1]), "runas-socket"), nil
+}
+
+// failure returns what, if anything, went wrong when a child
+// dropped privileges as asked by arg and reported r.
+func (r *internalDropResult) failure(arg *internalDropArg) error {
+	switch {
+	case !r.GroupsSet:
+		return r.idError("setgroups", r.SetgroupsErrno, capSetgid, "CAP_SETGID")
+	case !r.GidDropped:
+		return r.idError("setgid", r.SetgidErrno, capSetgid, "CAP_SETGID")
+	case !r.UidDropped:
+		return r.idError("setuid", r.SetuidErrno, capSetuid, "CAP_SETUID")
+	case arg.EffectiveOnly && r.Euid != arg.Uid:
+		return fmt.Errorf("child has euid %d, not %d", r.Euid, arg.Uid)
+	case arg.EffectiveOnly && r.Egid != arg.Gid:
+		return fmt.Errorf("child has egid %d, not %d", r.Egid, arg.Gid)
+	case !arg.EffectiveOnly && (r.Uid != arg.Uid || r.Euid != arg.Uid):
+		return fmt.Errorf("child has uid %d and euid %d, not %d", r.Uid, r.Euid, arg.Uid)
+	case !arg.EffectiveOnly && (r.Gid != arg.Gid || r.Egid != arg.Gid):
+		return fmt.Errorf("child has gid %d and egid %d, not %d", r.Gid, r.Egid, arg.Gid)
+	case !r.GroupsKept && !sameGroups(r.Groups, groupList(arg.Gid, arg.Groups)):
+		return fmt.Errorf("child has groups %v, not %v", r.Groups, groupList(arg.Gid, arg.Groups))
+	case arg.Uid != 0 && !hasCap(arg.Capabilities, capSetuid) && !arg.EffectiveOnly && !r.RegainRefused:
+		return errors.New("child could switch back to root")
+	case !slices.Equal(r.AllowedMethods, arg.AllowedMethods):
+		return fmt.Errorf("child restricted itself to methods %q, not %q", r.AllowedMethods, arg.AllowedMethods)
+	case r.OomScoreAdjErrno != 0:
+		return errnoError("setting oom_score_adj", r.OomScoreAdjErrno)
+	case r.CPUAffinityErrno != 0:
+		return errnoError("setting CPU affinity", r.CPUAffinityErrno)
+	case r.NiceErrno != 0:
+		return errnoError("setting nice value", r.NiceErrno)
+	case arg.Nice != nil && r.Nice != min(max(*arg.Nice, -20), 19):
+		return fmt.Errorf("child has nice value %d, not %d", r.Nice, *arg.Nice)
+	case r.CoreDumpsErrno != 0:
+		return errnoError("disabling core dumps", r.CoreDumpsErrno)
+	case r.NoNewPrivsErrno != 0:
+		return errnoError("setting no_new_privs", r.NoNewPrivsErrno)
+	}
+	for i, err := range r.rlimitErrors(arg) {
+		if err != nil && arg.Rlimits[i].Required {
+			return err
+		}
+	}
+	return nil
+}
+
+// rlimitErrors returns the error setting each of arg's Rlimits, nil
+// for those that were set.
+func (r *internalDropResult) rlimitErrors(arg *internalDropArg) []error {
+	errs := make([]error, len(arg.Rlimits))
+	for i, errno := range r.RlimitErrnos {
+		if errno != 0 && i < len(errs) {
+			errs[i] = errnoError(fmt.Sprintf("setting rlimit %d", arg.Rlimits[i].Resource), errno)
+		}
+	}
+	return errs
+}
+
+// idError is errnoError for op, a syscall that changes ids and
+// needs capability capNum, named capName, saying why it most likely
+// failed: for lack of privilege, or, in a sandbox such as gVisor or
+// a restrictive container runtime, because the sandbox refused it.
+func (r *internalDropResult) idError(op string, errno uintptr, capNum int, capName string) error {
+	err := errnoError(op, errno)
+	switch e := syscall.Errno(errno); {
+	case e == syscall.ENOSYS:
+		return fmt.Errorf("%w; the kernel or a sandbox doesn't implement it", err)
+	case e != syscall.EPERM:
+		return err
+	case r.CapsKnown && r.Caps&(1<<capNum) == 0:
+		return fmt.Errorf("%w; the child didn't have %s", err, capName)
+	case r.CapsKnown && r.SeccompMode == 2:
+		return fmt.Errorf("%w, though the child had %s; probably blocked by a seccomp filter", err, capName)
+	case r.CapsKnown:
+		return fmt.Errorf("%w, though the child had %s; probably refused by a sandbox or security module", err, capName)
+	case r.StartEuid != 0:
+		return fmt.Errorf("%w; the child wasn't root", err)
+	}
+	return err
+}
+
+// errnoError returns an error for op failing with errno, as sent
+// back by the child, naming the errno as its C constant too, since
+// strerror messages are the same for several.
+func errnoError(op string, errno uintptr) error {
+	e := syscall.Errno(errno)
+	if name, ok := errnoNames[e]; ok {
+		return fmt.Errorf("%s: %w (%s)", op, e, name)
+	}
+	return fmt.Errorf("%s: %w (errno %d)", op, e, errno)
+}
+
+// errnoNames has the errnos a drop can plausibly fail with.
+var errnoNames = map[syscall.Errno]string{
+	syscall.EPERM:  "EPERM",
+	syscall.ENOENT: "ENOENT",
+	syscall.EAGAIN: "EAGAIN",
+	syscall.ENOMEM: "ENOMEM",
+	syscall.EACCES: "EACCES",
+	syscall.EFAULT: "EFAULT",
+	syscall.EINVAL: "EINVAL",
+	syscall.ENOSYS: "ENOSYS",
+}
+
+// failedDropGrace is how long a child that failed to drop
+// privileges has to send its reply before it exits regardless.
+const failedDropGrace = 5 * time.Second
+
+// childDrop does what the parent asks of the child in the handshake,
+// reporting whether it fully dropped privileges and so may serve
+// calls. If not, serveHandshake replies and exits.
+func childDrop(arg *internalDropArg, result *internalDropResult) (ok bool, err error) {
+	ev := AuditEvent{
+		Child:     true,
+		ParentUid: os.Getuid(),
+		Pid:       os.Getpid(),
+		Uid:       arg.Uid,
+		Gid:       arg.Gid,
+		Groups:    groupList(arg.Gid, arg.Groups),
+
+		EffectiveOnly: arg.EffectiveOnly,
+	}
+	if arg.ChildConfig != nil {
+		childConfig.Store(&arg.ChildConfig)
+	}
+	err = dropPrivileges(arg, result)
+	ev.Err = err
+	if err == nil {
+		ev.Err = result.failure(arg)
+	}
+	if ev.Err != nil {
+		// In case the reply can't be written: a child that's
+		// partly dropped, or not at all, mustn't linger.
+		time.AfterFunc(failedDropGrace, func() { os.Exit(1) })
+	} else {
+		maxCallDuration.Store(int64(arg.MaxCallDuration))
+	}
+	audit(ev)
+	return ev.Err == nil, err
+}
+
+// dropPrivileges does the child's side of the handshake. The order
+// is fixed, since getting it wrong leaves privileges behind: setup,
+// oom_score_adj, CPU affinity, nice value, read-only root, chroot
+// and chdir to its root, setgroups, setgid, setuid, then limiting
+// what's left. The groups come from arg, resolved by the parent, so
+// nothing here needs /etc/passwd or /etc/group, which the new root
+// may not have.
+func dropPrivileges(arg *internalDropArg, result *internalDropResult) error {
+	// While still root and outside any chroot, since it may need
+	// /proc. It's cosmetic, so failure doesn't matter.
+	if arg.ProcessName != "" {
+		setProcessName(arg.ProcessName)
+	}
+
+	if arg.MountNamespace {
+		if err := makeMountsPrivate(); err != nil {
+			return fmt.Errorf("making mounts private: %v", err)
+		}
+	}
+
+	if name := arg.Setup; name != "" {
+		fn, ok := setupFunc(name)
+		if !ok {
+			return fmt.Errorf("no setup step %q registered in child", name)
+		}
+		if err := fn(); err != nil {
+			return fmt.Errorf("setup step %q: %v", name, err)
+		}
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("setup step %q didn't switch back to root", name)
+		}
+	}
+
+	if arg.OomScoreAdj != nil {
+		if err := setOomScoreAdj(*arg.OomScoreAdj); err != nil {
+			var errno syscall.Errno
+			if !errors.As(err, &errno) {
+				return fmt.Errorf("setting oom_score_adj: %v", err)
+			}
+			result.OomScoreAdjErrno = uintptr(errno)
+		}
+	}
+	if len(arg.CPUAffinity) > 0 {
+		if err := setCPUAffinity(arg.CPUAffinity); err != nil {
+			var errno syscall.Errno
+			if !errors.As(err, &errno) {
+				return fmt.Errorf("setting CPU affinity: %v", err)
+			}
+			result.CPUAffinityErrno = uintptr(errno)
+		}
+	}
+	if arg.Nice != nil {
+		if rv := setNice(*arg.Nice); rv != nil {
+			var errno syscall.Errno
+			if !errors.As(rv, &errno) {
+				return fmt.Errorf("setting nice value: %v", rv)
+			}
+			result.NiceErrno = uintptr(errno)
+		}
+	}
+
+	if arg.ReadOnlyRoot {
+		root := arg.Chroot
+		if root == "" {
+			root = "/"
+		}
+		if err := remountReadOnly(root); err != nil {
+			return fmt.Errorf("making %s read-only: %v", root, err)
+		}
+	}
+
+	// Chroot needs CAP_SYS_CHROOT, so it has to come before Setuid.
+	if dir := arg.Chroot; dir != "" {
+		if err := syscall.Chroot(dir); err != nil {
+			return fmt.Errorf("chroot %s: %v", dir, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir / in chroot %s: %v", dir, err)
+		}
+	}
+
+	// For explaining failures from here on.
+	result.StartEuid = os.Geteuid()
+	result.Caps, result.CapsKnown, result.SeccompMode = probeSandbox()
+
+	// Setgroups needs root, so it has to come before Setuid. Always
+	// set them, so the child doesn't keep root's.
+	rv := syscall.Setgroups(groupList(arg.Gid, arg.Groups))
+	if rv == syscall.EPERM && os.Geteuid() != 0 && arg.Uid == os.Getuid() && arg.Gid == os.Getgid() {
+		// A non-root parent "dropping" to itself; its groups are
+		// already its own.
+		rv = nil
+		result.GroupsKept = true
+	} else if rv == syscall.EPERM && arg.SetgroupsDenied {
+		// A non-root parent's namespace, where the kernel won't
+		// let anyone change groups.
+		rv = nil
+		result.GroupsKept = true
+	}
+	if rv != nil {
+		result.SetgroupsErrno = uintptr(rv.(syscall.Errno))
+		return nil
+	}
+	result.GroupsSet = true
+	if arg.Capabilities != nil {
+		if err := setKeepCaps(true); err != nil {
+			return fmt.Errorf("keeping capabilities: %v", err)
+		}
+	}
+	dropGid, dropUid := dropSetgid, dropSetuid
+	result.Mechanism = dropMechanism
+	if arg.EffectiveOnly {
+		dropGid, dropUid = syscall.Setegid, syscall.Seteuid
+		result.Mechanism = "seteuid"
+	}
+	// Stop at the first failure; the child is then in no state to
+	// do anything but exit, which serveHandshake sees to. Setgid
+	// must come strictly before setuid, since afterwards the child
+	// can't change its gid, so check that it took before going on.
+	if rv := dropGid(arg.Gid); rv != nil {
+		result.SetgidErrno = uintptr(rv.(syscall.Errno))
+		return nil
+	}
+	if gid, egid := syscall.Getgid(), syscall.Getegid(); egid != arg.Gid || (gid != arg.Gid && !arg.EffectiveOnly) {
+		return fmt.Errorf("setgid(%d) left gid %d and egid %d; not dropping uid", arg.Gid, gid, egid)
+	}
+	result.GidDropped = true
+	if rv := dropUid(arg.Uid); rv != nil {
+		result.SetuidErrno = uintptr(rv.(syscall.Errno))
+		return nil
+	}
+	result.UidDropped = true
+	result.Uid, result.Euid = syscall.Getuid(), syscall.Geteuid()
+	result.Gid, result.Egid = syscall.Getgid(), syscall.Getegid()
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		return fmt.Errorf("getgroups: %v", err)
+	}
+	result.Groups = groups
+	if arg.Nice != nil {
+		if result.Nice, err = getNice(); err != nil {
+			return fmt.Errorf("getpriority: %v", err)
+		}
+	}
+	if err := rearmParentDeathSignal(arg.ParentPid); err != nil {
+		return fmt.Errorf("setting parent-death signal: %v", err)
+	}
+	if arg.Capabilities != nil {
+		if err := limitCaps(arg.Capabilities); err != nil {
+			return fmt.Errorf("limiting capabilities: %v", err)
+		}
+		setKeepCaps(false)
+	}
+	// Only now, so that it's relative to the chroot and checked
+	// against the new user's permissions.
+	if dir := arg.WorkingDir; dir != "" {
+		if err := syscall.Chdir(dir); err != nil {
+			return fmt.Errorf("chdir %s: %v", dir, err)
+		}
+	}
+	if arg.Umask != nil {
+		syscall.Umask(*arg.Umask)
+	}
+	if arg.NoNewPrivs {
+		if rv := setNoNewPrivs(); rv != nil {
+			errno, ok := rv.(syscall.Errno)
+			if !ok {
+				return fmt.Errorf("setting no_new_privs: %v", rv)
+			}
+			result.NoNewPrivsErrno = uintptr(errno)
+		}
+	}
+	for _, rl := range arg.Rlimits {
+		var errno uintptr
+		if rv := setrlimit(rl); rv != nil {
+			errno = uintptr(rv.(syscall.Errno))
+		}
+		result.RlimitErrnos = append(result.RlimitErrnos, errno)
+	}
+	if arg.DisableCoreDumps {
+		rv := setrlimit(Rlimit{Resource: syscall.RLIMIT_CORE})
+		if rv == nil {
+			rv = setNotDumpable()
+		}
+		if rv != nil {
+			result.CoreDumpsErrno = uintptr(rv.(syscall.Errno))
+		}
+	}
+	if arg.Uid != 0 && !hasCap(arg.Capabilities, capSetuid) && !arg.EffectiveOnly {
+		if rv := setuid(0); rv == nil {
+			// Something is badly wrong.
+			return fmt.Errorf("child regained root after dropping to uid %d", arg.Uid)
+		} else if rv == syscall.EPERM {
+			result.RegainRefused = true
+		}
+	}
+	// Last, since the filter may well forbid what came before.
+	if name := arg.SeccompFilter; name != "" {
+		prog, ok := seccompFilter(name)
+		if !ok {
+			return fmt.Errorf("no seccomp filter %q registered in child", name)
+		}
+		if err := installSeccomp(prog); err != nil {
+			return fmt.Errorf("installing seccomp filter %q: %v", name, err)
+		}
+	}
+	result.AllowedMethods = setAllowedMethods(arg.AllowedMethods)
+	internalRefused.Store(arg.RefuseInternal)
+	return nil
+}
+
+// dropSetgid and dropSetuid are what dropPrivileges drops ids with,
+// as variables so that tests can fake them failing.
+var dropSetgid, dropSetuid = setgid, setuid
+
+// checkNoInheritedFds checks, for Config.Hardened, that cmd won't
+// pass the child any descriptors beyond stdin, stdout, stderr and
+// extra, the ExtraFiles that runas itself set.
+func checkNoInheritedFds(cmd *exec.Cmd, extra []*os.File) error {
+	if !slices.Equal(cmd.ExtraFiles, extra) {
+		return errors.New("runas: Hardened child can't be given ExtraFiles")
+	}
+	var passed []int
+	for _, f := range extra {
+		passed = append(passed, int(f.Fd()))
+	}
+	fd, err := inheritableFd(passed)
+	if err != nil {
+		return fmt.Errorf("runas: failed to check for inheritable descriptors: %w", err)
+	}
+	if fd != -1 {
+		return fmt.Errorf("runas: descriptor %d isn't close-on-exec and would leak into Hardened child", fd)
+	}
+	return nil
+}
+
+// groupList returns the supplementary groups to set for a child
+// with primary group gid and the given groups: gid first, as BSD
+// setgroups wants, then the rest, cut to what the system accepts,
+// which is how initgroups(3) copes with too many.
+func groupList(gid int, groups []int) []int {
+	list := []int{gid}
+	for _, g := range groups {
+		if len(list) == ngroupsMax {
+			break
+		}
+		if g != gid {
+			list = append(list, g)
+		}
+	}
+	return list
+}
+
+// sameGroups reports whether a and b have the same groups, in any
+// order.
+func sameGroups(a, b []int) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+// isCharDevice reports whether r is a file that's a character
+// device, such as a terminal.
+func isCharDevice(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func setrlimit(rl Rlimit) error {
+	var lim syscall.Rlimit
+	// The field types vary between systems.
+	setLimit(&lim.Cur, rl.Cur)
+	setLimit(&lim.Max, rl.Max)
+	return syscall.Setrlimit(rl.Resource, &lim)
+}
+
+func setLimit[T ~int64 | ~uint64](p *T, v uint64) {
+	*p = T(v)
+}
+
+func hasCap(caps []int, c int) bool {
+	for _, have := range caps {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
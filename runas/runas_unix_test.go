@@ -0,0 +1,508 @@
+//go:build !windows
+
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	// A setgid that reports success but changes nothing, and a
+	// setuid that does nothing at all, to check that the child
+	// notices the one before calling the other.
+	RegisterSetup("test-setgid-noop", func() error {
+		dropSetgid = func(int) error { return nil }
+		dropSetuid = func(int) error { panic("setuid called after setgid failed") }
+		return nil
+	})
+	RegisterTransport("test-socket", testTransport{})
+	// A child that takes a while to be ready.
+	RegisterSetup("test-slow-ready", func() error {
+		time.AfterFunc(300*time.Millisecond, DelayReady())
+		return nil
+	})
+}
+
+// Groups replies with the child's supplementary groups.
+func (TestService) Groups(arg bool, groups *[]int) error {
+	var err error
+	*groups, err = syscall.Getgroups()
+	return err
+}
+
+// needRoot skips t unless the test can drop privileges.
+func needRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+}
+
+// startChild starts a child of the test binary as uid and gid 65534
+// with conf, closing it when t is done.
+func startChild(t *testing.T, conf *Config) *Client {
+	t.Helper()
+	needRoot(t)
+	if conf == nil {
+		conf = new(Config)
+	}
+	c, err := conf.UidGid(context.Background(), 65534, 65534)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCloseWithGrandchildHoldingStderr(t *testing.T) {
+	c := startChild(t, nil)
+	var pid int
+	if err := c.Call("TestService.StartGrandchild", true, &pid); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	start := time.Now()
+	c.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Close took %v with a grandchild holding stderr", d)
+	}
+}
+
+func TestPoolCallRetriesKilledChild(t *testing.T) {
+	needRoot(t)
+	for _, socket := range []bool{false, true} {
+		t.Run(fmt.Sprintf("socket=%v", socket), func(t *testing.T) {
+			// Not t.TempDir, whose parent the child can't get into.
+			dir, err := os.MkdirTemp("", "runas-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := os.Chmod(dir, 0o777); err != nil {
+				t.Fatal(err)
+			}
+			p := &Pool{Config: &Config{Socket: socket}}
+			defer p.Close()
+			var ok bool
+			if err := p.Call("nobody", "TestService.DieOnce", filepath.Join(dir, "died"), &ok); err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Error("call wasn't retried")
+			}
+		})
+	}
+}
+
+func TestSetgidCheckedBeforeSetuid(t *testing.T) {
+	needRoot(t)
+	_, err := (&Config{Setup: "test-setgid-noop"}).UidGid(context.Background(), 65534, 65534)
+	if err == nil || !strings.Contains(err.Error(), "not dropping uid") {
+		t.Fatalf("err = %v; want setgid's failure to stop the drop", err)
+	}
+	var de *DropError
+	if errors.As(err, &de) && (de.GidDropped || de.UidDropped) {
+		t.Errorf("DropError says gid dropped %v, uid dropped %v", de.GidDropped, de.UidDropped)
+	}
+}
+
+func TestChrootEmptyDir(t *testing.T) {
+	needRoot(t)
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := UidGidChroot(65534, 65534, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var names []string
+	if err := c.Call("TestService.Root", true, &names); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("child's root has %q; want nothing", names)
+	}
+}
+
+// TestGroupsAfterDrop checks, with getgroups(2) in the child, that
+// it doesn't keep root's groups: by default it has only its gid, and
+// with InitGroups its user's groups.
+func TestGroupsAfterDrop(t *testing.T) {
+	needRoot(t)
+	u, err := user.LookupId("65534")
+	if err != nil {
+		t.Skip(err)
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		t.Skip(err)
+	}
+	userGroups := []int{65534}
+	for _, id := range ids {
+		if gid, err := strconv.Atoi(id); err == nil {
+			userGroups = append(userGroups, gid)
+		}
+	}
+	slices.Sort(userGroups)
+	userGroups = slices.Compact(userGroups)
+	for _, tt := range []struct {
+		conf *Config
+		want []int
+	}{
+		{&Config{}, []int{65534}},
+		{&Config{InitGroups: true}, userGroups},
+	} {
+		c := startChild(t, tt.conf)
+		var groups []int
+		if err := c.Call("TestService.Groups", true, &groups); err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(groups)
+		groups = slices.Compact(groups)
+		if !slices.Equal(groups, tt.want) {
+			t.Errorf("InitGroups %v: child has groups %v; want %v", tt.conf.InitGroups, groups, tt.want)
+		}
+	}
+}
+
+func TestFailureChecksGroups(t *testing.T) {
+	arg := &internalDropArg{Uid: 1001, Gid: 1001, Groups: []int{1002}}
+	tests := []struct {
+		groups []int
+		kept   bool
+		ok     bool
+	}{
+		{groups: []int{1001, 1002}, ok: true},
+		{groups: []int{1002, 1001, 1002}, ok: true},
+		{groups: []int{1001}},
+		{groups: []int{0, 1001, 1002}},
+		{groups: nil},
+		{groups: []int{0}, kept: true, ok: true},
+	}
+	for _, tt := range tests {
+		r := &internalDropResult{
+			GroupsSet:     true,
+			GidDropped:    true,
+			UidDropped:    true,
+			GroupsKept:    tt.kept,
+			Groups:        tt.groups,
+			Uid:           1001,
+			Euid:          1001,
+			Gid:           1001,
+			Egid:          1001,
+			RegainRefused: true,
+		}
+		err := r.failure(arg)
+		if (err == nil) != tt.ok {
+			t.Errorf("groups %v, kept %v: failure = %v; want ok %v", tt.groups, tt.kept, err, tt.ok)
+		}
+	}
+}
+
+func TestAddedServices(t *testing.T) {
+	c := startChild(t, nil)
+	names, err := c.AddedServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("before AddService: %q; want none", names)
+	}
+	if err := c.AddService("TestAdded"); err != nil {
+		t.Fatal(err)
+	}
+	names, err = c.AddedServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, []string{"TestAdded"}) {
+		t.Errorf("after AddService: %q; want [TestAdded]", names)
+	}
+	var groups []int
+	if err := c.Call("TestAdded.Groups", true, &groups); err != nil {
+		t.Errorf("calling added service: %v", err)
+	}
+}
+
+func TestShutdownFinishesCalls(t *testing.T) {
+	for _, conf := range []Config{{}, {Socket: true}, {Socket: true, TLS: true}} {
+		t.Run(fmt.Sprintf("socket=%v,tls=%v", conf.Socket, conf.TLS), func(t *testing.T) {
+			c := startChild(t, &conf)
+			var ok bool
+			call := c.Go("TestService.Sleep", 200*time.Millisecond, &ok, nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := c.Shutdown(ctx); err != nil {
+				t.Errorf("Shutdown: %v", err)
+			}
+			<-call.Done
+			if call.Error != nil || !ok {
+				t.Errorf("call in flight: ok %v, err %v", ok, call.Error)
+			}
+			if err := c.Call("TestService.Sleep", time.Duration(0), &ok); err == nil {
+				t.Error("call after Shutdown succeeded")
+			}
+		})
+	}
+}
+
+// TestPoolGetDoesntPing checks that Get hands out a child that's
+// alive but not answering, as a busy one might not, rather than
+// replacing it under its other callers.
+func TestPoolGetDoesntPing(t *testing.T) {
+	needRoot(t)
+	p := &Pool{Config: &Config{HandshakeTimeout: 100 * time.Millisecond}}
+	defer p.Close()
+	c1, err := p.Get("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(c1.Pid(), syscall.SIGSTOP); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(c1.Pid(), syscall.SIGCONT)
+	c2, err := p.Get("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2 != c1 {
+		t.Error("Get replaced a stopped child")
+	}
+	syscall.Kill(c1.Pid(), syscall.SIGCONT)
+	var ok bool
+	if err := p.Call("nobody", "TestService.Sleep", time.Duration(0), &ok); err != nil {
+		t.Error(err)
+	}
+}
+
+// gone reports whether pid has exited, as a zombie that nothing has
+// reaped yet has.
+func gone(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return syscall.Kill(pid, 0) == syscall.ESRCH
+	}
+	// The state follows the parenthesized command name.
+	i := strings.LastIndexByte(string(stat), ')')
+	return i >= 0 && strings.HasPrefix(string(stat[i+1:]), " Z")
+}
+
+func TestSetpgidKillsGroup(t *testing.T) {
+	for _, shutdown := range []bool{false, true} {
+		t.Run(fmt.Sprintf("shutdown=%v", shutdown), func(t *testing.T) {
+			c := startChild(t, &Config{Setpgid: true})
+			var pid int
+			if err := c.Call("TestService.StartGrandchild", true, &pid); err != nil {
+				t.Fatal(err)
+			}
+			defer syscall.Kill(pid, syscall.SIGKILL)
+			if shutdown {
+				if err := c.Shutdown(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				c.Close()
+			}
+			// SIGKILL takes effect soon, but not at once.
+			for start := time.Now(); !gone(pid); time.Sleep(10 * time.Millisecond) {
+				if time.Since(start) > 2*time.Second {
+					t.Fatalf("grandchild %d still running", pid)
+				}
+			}
+		})
+	}
+}
+
+func TestRlimitErrors(t *testing.T) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		t.Fatal(err)
+	}
+	// Once it has dropped root, the child can't raise its hard limit.
+	raise := Rlimit{Resource: syscall.RLIMIT_NOFILE, Cur: uint64(rl.Max) + 1, Max: uint64(rl.Max) + 1}
+	lower := Rlimit{Resource: syscall.RLIMIT_NOFILE, Cur: 64, Max: 64}
+	c := startChild(t, &Config{Rlimits: []Rlimit{raise, lower}})
+	errs := c.RlimitErrors()
+	if len(errs) != 2 || !errors.Is(errs[0], syscall.EPERM) || errs[1] != nil {
+		t.Errorf("RlimitErrors = %v; want [EPERM <nil>]", errs)
+	}
+	if err := c.ping(context.Background()); err != nil {
+		t.Errorf("child with an unset limit: %v", err)
+	}
+
+	raise.Required = true
+	conf := &Config{Rlimits: []Rlimit{lower, raise}}
+	if c, err := conf.UidGid(context.Background(), 65534, 65534); err == nil {
+		c.Close()
+		t.Error("child started without a required limit")
+	} else if !errors.Is(err, syscall.EPERM) || !strings.Contains(err.Error(), "rlimit") {
+		t.Errorf("error = %v; want EPERM setting rlimit", err)
+	}
+}
+
+func TestReadyNotBoundedByMaxCallDuration(t *testing.T) {
+	c := startChild(t, &Config{
+		Setup:           "test-slow-ready",
+		ReadyTimeout:    5 * time.Second,
+		MaxCallDuration: 100 * time.Millisecond,
+	})
+	var ok bool
+	if err := c.Call("TestService.Sleep", time.Millisecond, &ok); err != nil {
+		t.Errorf("short call: %v", err)
+	}
+	if err := c.Call("TestService.Sleep", time.Second, &ok); err == nil {
+		t.Error("call longer than MaxCallDuration succeeded")
+	}
+}
+
+// testTransport connects over a socketpair, like SocketTransport but
+// passing the child's end its own way.
+type testTransport struct{}
+
+func (testTransport) Connect(cmd *exec.Cmd) (io.ReadWriteCloser, []*os.File, error) {
+	mine, theirs, err := socketpair()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, theirs)
+	cmd.Env = append(cmd.Env, "RUNAS_TEST_TRANSPORT_FD="+strconv.Itoa(2+len(cmd.ExtraFiles)))
+	return mine, []*os.File{theirs}, nil
+}
+
+func (testTransport) Accept() (io.ReadWriteCloser, error) {
+	fd, err := strconv.Atoi(os.Getenv("RUNAS_TEST_TRANSPORT_FD"))
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "test-transport"), nil
+}
+
+func TestRegisteredTransport(t *testing.T) {
+	c := startChild(t, &Config{Transport: "test-socket"})
+	if got := c.Transport(); got != "test-socket" {
+		t.Errorf("Transport = %q; want test-socket", got)
+	}
+	if c.Socket() {
+		t.Error("Socket = true")
+	}
+	var ok bool
+	if err := c.Call("TestService.Sleep", time.Millisecond, &ok); err != nil || !ok {
+		t.Errorf("call = %v, %v", ok, err)
+	}
+}
+
+func TestBadTransport(t *testing.T) {
+	for _, conf := range []*Config{
+		{Transport: "no-such-transport"},
+		{Transport: SocketTransport, Socket: true},
+		{TLS: true},
+	} {
+		if c, err := conf.UidGid(context.Background(), 65534, 65534); err == nil {
+			c.Close()
+			t.Errorf("%+v: started a child", conf)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	for _, internal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("internal=%v", internal), func(t *testing.T) {
+			ext, far := net.Pipe()
+			c := startChild(t, &Config{Conn: ext, ConnInternal: internal})
+			remote := rpc.NewClient(far)
+			defer remote.Close()
+			var ok bool
+			if err := remote.Call("TestService.Sleep", time.Millisecond, &ok); err != nil || !ok {
+				t.Errorf("call over Conn = %v, %v", ok, err)
+			}
+			if err := remote.Call("InternalGoRunAs.Ping", true, &ok); err != nil {
+				t.Errorf("Ping over Conn: %v", err)
+			}
+			var names []string
+			err := remote.Call("InternalGoRunAs.AddedServices", true, &names)
+			if internal && err != nil {
+				t.Errorf("AddedServices with ConnInternal: %v", err)
+			} else if !internal && (err == nil || !strings.Contains(err.Error(), "not allowed")) {
+				t.Errorf("AddedServices over Conn: %v; want not allowed", err)
+			}
+			if err := c.Call("TestService.Sleep", time.Millisecond, &ok); err == nil {
+				t.Error("Client call succeeded with Config.Conn")
+			}
+
+			// Hanging up makes the child exit.
+			remote.Close()
+			done := make(chan error, 1)
+			go func() {
+				_, err := c.Wait()
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("child exited with %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("child still running after Conn's other end hung up")
+			}
+		})
+	}
+}
+
+func TestChildEnvShell(t *testing.T) {
+	root, err := user.LookupId("0")
+	if err != nil {
+		t.Skip(err)
+	}
+	want := loginShell(root)
+	if want == "" {
+		t.Skip("root has no login shell in /etc/passwd")
+	}
+	for _, tt := range []struct {
+		u     *user.User
+		shell string
+	}{
+		{root, want},
+		{&user.User{Uid: "12345", Username: "no-such-user"}, "/bin/sh"},
+	} {
+		env, err := new(Config).childEnv(tt.u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(env, "SHELL="+tt.shell) {
+			t.Errorf("%s: env %q; want SHELL=%s", tt.u.Username, env, tt.shell)
+		}
+	}
+}
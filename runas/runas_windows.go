@@ -0,0 +1,56 @@
+//go:build windows
+
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/user"
+)
+
+// Windows has no setuid, so the package builds there but can't
+// start children: spawning fails and MaybeRunChildServer never
+// takes over the process.
+
+var errUnsupported = errors.New("runas: unsupported on windows")
+
+func isChild() bool {
+	return false
+}
+
+func (c *Config) spawn(ctx context.Context, arg *internalDropArg, u *user.User) (*Client, error) {
+	return nil, errUnsupported
+}
+
+func childDrop(arg *internalDropArg, result *internalDropResult) (ok bool, err error) {
+	return false, errUnsupported
+}
+
+func socketpair() (*os.File, *os.File, error) {
+	return nil, nil, errUnsupported
+}
+
+func (c *Client) kill() {
+	c.cmd.Process.Kill()
+}
+
+func (c *Client) killProcessGroup() {}
+
+func (c *Client) killGroupOnExit() {}
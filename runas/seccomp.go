@@ -0,0 +1,56 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import "sync"
+
+// BPFInstruction is one instruction of a classic BPF program, laid
+// out like struct sock_filter in <linux/filter.h>.
+type BPFInstruction struct {
+	Code   uint16
+	Jt, Jf uint8
+	K      uint32
+}
+
+var (
+	seccompMu      sync.Mutex
+	seccompFilters = map[string][]BPFInstruction{}
+)
+
+// RegisterSeccompFilter registers prog as the seccomp filter named
+// name, for children started with Config.SeccompFilter set to name.
+// Like services, filters must be registered before
+// MaybeRunChildServer, since it's the child's own registration that
+// gets installed.
+func RegisterSeccompFilter(name string, prog []BPFInstruction) {
+	if name == "" || len(prog) == 0 {
+		panic("runas: RegisterSeccompFilter needs a name and a program")
+	}
+	seccompMu.Lock()
+	defer seccompMu.Unlock()
+	if _, dup := seccompFilters[name]; dup {
+		panic("runas: RegisterSeccompFilter called twice for " + name)
+	}
+	seccompFilters[name] = prog
+}
+
+func seccompFilter(name string) ([]BPFInstruction, bool) {
+	seccompMu.Lock()
+	defer seccompMu.Unlock()
+	prog, ok := seccompFilters[name]
+	return prog, ok
+}
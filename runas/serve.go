@@ -0,0 +1,297 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serveCodec is like (*rpc.Server).ServeCodec, but a panic in a
+// service method is recovered and sent to the caller as the call's
+// error, along with a stack trace, instead of killing the child.
+//
+// net/rpc gives no way to recover panics from the goroutines
+// ServeCodec starts, so instead each request is served by its own
+// ServeRequest call, which runs the method on the calling
+// goroutine. Requests are still read one at a time and handled
+// concurrently: each goroutine starts the next once it's done
+// reading its own request.
+//
+// It returns once the connection ends and every request is done:
+// nil if the other end closed it cleanly, or else why it broke, such
+// as a request that couldn't be decoded.
+func serveCodec(s *rpc.Server, codec rpc.ServerCodec) error {
+	sc := &serverConn{codec: codec, read: make(chan bool)}
+	for {
+		sc.wg.Add(1)
+		go sc.serveOne(s)
+		if !<-sc.read {
+			break
+		}
+	}
+	sc.wg.Wait()
+	codec.Close()
+	return sc.err
+}
+
+// maxCallDuration, if positive, is how long the child lets a call
+// run before exiting; see Config.MaxCallDuration.
+var maxCallDuration atomic.Int64
+
+// allowedMethods, if non-nil, is the set of methods the child
+// serves, besides alwaysAllowed; see Config.AllowMethods.
+var allowedMethods atomic.Pointer[map[string]bool]
+
+// internalRefused is whether the child refuses the package's own
+// methods, but for alwaysAllowed; see Config.Conn.
+var internalRefused atomic.Bool
+
+// alwaysAllowed are the internal methods the parent needs whatever
+// the child is allowed.
+var alwaysAllowed = map[string]bool{
+	"InternalGoRunAs.Ping":           true,
+	"InternalGoRunAs.Ready":          true,
+	"InternalGoRunAs.AllowedMethods": true,
+}
+
+// setAllowedMethods restricts the child to methods, if any, and
+// returns the list it's restricted to, sorted, for the parent to
+// check.
+func setAllowedMethods(methods []string) []string {
+	if len(methods) == 0 {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, name := range methods {
+		m[name] = true
+	}
+	allowedMethods.Store(&m)
+	return sortedKeys(m)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func methodAllowed(name string) bool {
+	if alwaysAllowed[name] {
+		return true
+	}
+	if internalRefused.Load() && strings.HasPrefix(name, InternalServiceName+".") {
+		return false
+	}
+	m := allowedMethods.Load()
+	return m == nil || (*m)[name]
+}
+
+// AllowedMethods returns the methods the child is restricted to, or
+// nil if it isn't, for Client.AllowedMethods.
+func (s *internalService) AllowedMethods(arg bool, names *[]string) error {
+	if m := allowedMethods.Load(); m != nil {
+		*names = sortedKeys(*m)
+	}
+	return nil
+}
+
+// serverConn is the state shared by the goroutines serving one
+// connection.
+type serverConn struct {
+	codec   rpc.ServerCodec
+	read    chan bool // one value per request: whether to keep reading
+	err     error     // why reading stopped, unless at a clean EOF
+	wg      sync.WaitGroup
+	writeMu sync.Mutex
+}
+
+func (sc *serverConn) serveOne(s *rpc.Server) {
+	defer sc.wg.Done()
+	rc := &requestCodec{sc: sc}
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		rc.stopWatchdog()
+		msg := fmt.Sprintf("runas: panic serving %s: %v\n%s", rc.req.ServiceMethod, v, debug.Stack())
+		fmt.Fprintln(os.Stderr, msg)
+		if !rc.replied {
+			resp := &rpc.Response{ServiceMethod: rc.req.ServiceMethod, Seq: rc.req.Seq, Error: msg}
+			sc.writeMu.Lock()
+			sc.codec.WriteResponse(resp, struct{}{})
+			sc.writeMu.Unlock()
+		}
+	}()
+	s.ServeRequest(rc)
+}
+
+// requestCodec is the codec for serving a single request on sc. It
+// remembers the request so that a panic can be answered, and lets
+// sc know when the request has been read.
+type requestCodec struct {
+	sc        *serverConn
+	req       rpc.Request
+	replied   bool
+	watchdog  *time.Timer // if non-nil, exits if the call runs too long
+	forbidden bool        // the method isn't allowed; see methodAllowed
+}
+
+func (rc *requestCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := rc.sc.codec.ReadRequestHeader(r)
+	if err != nil {
+		// net/rpc gives up on the connection after a bad header.
+		if err != io.EOF {
+			rc.sc.err = err
+		}
+		rc.sc.read <- false
+		return err
+	}
+	rc.req = *r
+	if !methodAllowed(r.ServiceMethod) {
+		// Have net/rpc call something harmless instead, and
+		// replace its reply with the error.
+		rc.forbidden = true
+		r.ServiceMethod = "InternalGoRunAs.Ping"
+	}
+	return nil
+}
+
+func (rc *requestCodec) ReadRequestBody(body any) error {
+	if rc.forbidden {
+		// Discard the body, meant for another method.
+		body = nil
+	}
+	err := rc.sc.codec.ReadRequestBody(body)
+	rc.sc.read <- true
+	if d := time.Duration(maxCallDuration.Load()); d > 0 && bounded(rc.req.ServiceMethod) {
+		method := rc.req.ServiceMethod
+		rc.watchdog = time.AfterFunc(d, func() {
+			// net/rpc can't stop a method, so stop everything.
+			fmt.Fprintf(os.Stderr, "runas: %s ran longer than %v; exiting\n", method, d)
+			os.Exit(2)
+		})
+	}
+	return err
+}
+
+// bounded reports whether method is subject to maxCallDuration. The
+// package's own methods aren't, since Ready, for one, waits as long
+// as Config.ReadyTimeout allows; RunTask is, since it runs the
+// caller's code.
+func bounded(method string) bool {
+	internal, ok := strings.CutPrefix(method, InternalServiceName+".")
+	return !ok || internal == "RunTask"
+}
+
+func (rc *requestCodec) stopWatchdog() {
+	if rc.watchdog != nil {
+		rc.watchdog.Stop()
+	}
+}
+
+func (rc *requestCodec) WriteResponse(r *rpc.Response, body any) error {
+	rc.stopWatchdog()
+	if rc.forbidden {
+		r.ServiceMethod = rc.req.ServiceMethod
+		r.Error = "runas: method " + rc.req.ServiceMethod + " is not allowed in this child"
+	}
+	rc.sc.writeMu.Lock()
+	defer rc.sc.writeMu.Unlock()
+	rc.replied = true
+	return rc.sc.codec.WriteResponse(r, body)
+}
+
+// Close does nothing; serveCodec closes the underlying codec once
+// every request is done.
+func (rc *requestCodec) Close() error {
+	return nil
+}
+
+// gobServerCodec is net/rpc's unexported gob ServerCodec, which
+// ServeConn uses.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body any) error {
+	return gobTypeHint(c.dec.Decode(body))
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body any) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header. Shouldn't happen, so
+			// shut down the connection to signal that it did.
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		err = gobTypeHint(err)
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header
+			// has been written. Shut down the connection to signal
+			// that the connection is broken.
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are
+		// undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"fmt"
+	"net/rpc"
+	"slices"
+	"sync"
+)
+
+var (
+	lazyMu       sync.Mutex
+	lazyServices = map[string]func() any{}
+	added        = map[*rpc.Server][]string{} // in the child, from AddService, in order
+)
+
+// RegisterService makes newRcvr available as the service named name,
+// to be added to a child that's already running with
+// Client.AddService. Services registered on Server directly are
+// fixed once MaybeRunChildServer is called, which in a child never
+// returns to run the rest of main; this is for services that only
+// some children need, or that a plugin enables later. Like the
+// service itself, it must be registered in the child, so call it
+// before MaybeRunChildServer. newRcvr is called in the child, when
+// the service is added, and its result registered as with
+// rpc.RegisterName.
+func RegisterService(name string, newRcvr func() any) {
+	if name == "" || newRcvr == nil {
+		panic("runas: RegisterService needs a name and a function")
+	}
+	if name == InternalServiceName {
+		panic("runas: RegisterService can't use the reserved name " + name)
+	}
+	lazyMu.Lock()
+	defer lazyMu.Unlock()
+	if _, dup := lazyServices[name]; dup {
+		panic("runas: RegisterService called twice for " + name)
+	}
+	lazyServices[name] = newRcvr
+}
+
+// AddService adds the service registered in the child as name with
+// RegisterService to the child's server, so that c can call its
+// methods. Adding a service that's already been added is an error.
+func (c *Client) AddService(name string) error {
+	var ok bool
+	return c.Call("InternalGoRunAs.AddService", name, &ok)
+}
+
+// AddedServices returns the names of the services added to the
+// child with AddService, in the order they were added. Services
+// registered on the child's server directly, as with Server.Register,
+// aren't included, since net/rpc has no way to list them.
+func (c *Client) AddedServices() ([]string, error) {
+	var names []string
+	err := c.Call("InternalGoRunAs.AddedServices", true, &names)
+	return names, err
+}
+
+// AddService adds a service for Client.AddService.
+func (s *internalService) AddService(name string, ok *bool) error {
+	lazyMu.Lock()
+	defer lazyMu.Unlock()
+	newRcvr, found := lazyServices[name]
+	if !found {
+		return fmt.Errorf("runas: no service %q registered in child", name)
+	}
+	if slices.Contains(added[s.server], name) {
+		return fmt.Errorf("runas: service %q already added", name)
+	}
+	if err := s.server.RegisterName(name, newRcvr()); err != nil {
+		return err
+	}
+	added[s.server] = append(added[s.server], name)
+	*ok = true
+	return nil
+}
+
+// AddedServices lists services for Client.AddedServices.
+func (s *internalService) AddedServices(arg bool, names *[]string) error {
+	lazyMu.Lock()
+	defer lazyMu.Unlock()
+	*names = slices.Clone(added[s.server])
+	return nil
+}
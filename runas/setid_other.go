@@ -0,0 +1,43 @@
+//go:build !linux && !windows && !freebsd
+
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import "syscall"
+
+// On macOS, the other BSDs, Solaris and AIX we rely on setuid and
+// setgid, which for a privileged caller set the real, effective and
+// saved ids together as POSIX requires. Package syscall has no
+// setresuid for them, and on macOS and OpenBSD system calls have to
+// go through libc.
+const dropMechanism = "setuid"
+
+func setuid(uid int) error {
+	return syscall.Setuid(uid)
+}
+
+func setgid(gid int) error {
+	return syscall.Setgid(gid)
+}
+
+// ngroupsMax is the most supplementary groups setgroups accepts. The
+// usual NGROUPS_MAX is 16; macOS in particular rejects more, though
+// getgroups there can report more for a user whose process didn't
+// call setgroups. Some systems, illumos for one, can be configured
+// higher, but a list cut to 16 is never more privileged.
+const ngroupsMax = 16
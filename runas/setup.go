@@ -0,0 +1,48 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import "sync"
+
+var (
+	setupMu    sync.Mutex
+	setupFuncs = map[string]func() error{}
+)
+
+// RegisterSetup registers fn as the setup step named name, for
+// children started with Config.Setup set to name. Like seccomp
+// filters, setup steps must be registered before
+// MaybeRunChildServer, since it's the child's own registration that
+// runs.
+func RegisterSetup(name string, fn func() error) {
+	if name == "" || fn == nil {
+		panic("runas: RegisterSetup needs a name and a function")
+	}
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	if _, dup := setupFuncs[name]; dup {
+		panic("runas: RegisterSetup called twice for " + name)
+	}
+	setupFuncs[name] = fn
+}
+
+func setupFunc(name string) (func() error, bool) {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	fn, ok := setupFuncs[name]
+	return fn, ok
+}
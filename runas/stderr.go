@@ -0,0 +1,127 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// stderrTailLines is how many lines of a child's stderr are kept
+// for reporting startup failures.
+const stderrTailLines = 10
+
+// stderrWaitDelay is how long reaping a child waits, once it has
+// exited, for its stderr to reach EOF before giving up on the rest.
+const stderrWaitDelay = 100 * time.Millisecond
+
+// stderrTail is the child's stderr. It remembers the last few lines
+// written, and copies everything to w if it's non-nil.
+type stderrTail struct {
+	w io.Writer
+
+	mu      sync.Mutex
+	buf     []byte
+	label   []byte // if non-nil, starts each line copied to w
+	midLine bool   // whether the last byte copied to w wasn't a newline
+	holding bool   // whether to keep what's written from w until setLabel
+	held    []byte
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	t.buf = append(t.buf, p...)
+	// Lines are rarely long; 4KB is plenty for the last few.
+	if n := len(t.buf) - 4<<10; n > 0 {
+		t.buf = append(t.buf[:0], t.buf[n:]...)
+	}
+	if t.holding {
+		t.held = append(t.held, p...)
+		t.mu.Unlock()
+		return len(p), nil
+	}
+	out := p
+	if t.w != nil && t.label != nil {
+		out = t.labelLines(p)
+	}
+	t.mu.Unlock()
+	if t.w != nil {
+		// Errors shouldn't stop the child, so drop them.
+		t.w.Write(out)
+	}
+	return len(p), nil
+}
+
+// setLabel makes each line copied to w start with label, including
+// any held until now.
+func (t *stderrTail) setLabel(label string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.label = []byte(label)
+	t.holding = false
+	if len(t.held) > 0 && t.w != nil {
+		// Under t.mu, so that it's not overtaken by later writes.
+		t.w.Write(t.labelLines(t.held))
+	}
+	t.held = nil
+}
+
+// labelLines returns p with t.label at the start of each line.
+// t.mu must be held.
+func (t *stderrTail) labelLines(p []byte) []byte {
+	var out []byte
+	for len(p) > 0 {
+		if !t.midLine {
+			out = append(out, t.label...)
+		}
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		out = append(out, line...)
+		t.midLine = line[len(line)-1] != '\n'
+		p = p[len(line):]
+	}
+	return out
+}
+
+// tail returns the last stderrTailLines lines written.
+func (t *stderrTail) tail() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := bytes.TrimRight(t.buf, "\n")
+	for i, n := len(b)-1, 0; i >= 0; i-- {
+		if b[i] == '\n' {
+			if n++; n == stderrTailLines {
+				b = b[i+1:]
+				break
+			}
+		}
+	}
+	return string(b)
+}
+
+// annotate adds the tail of the child's stderr, if any, to err.
+func (t *stderrTail) annotate(err error) error {
+	if s := t.tail(); s != "" {
+		return fmt.Errorf("%w; child stderr:\n%s", err, s)
+	}
+	return err
+}
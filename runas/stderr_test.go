@@ -0,0 +1,50 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStderrLabelHoldsEarlyOutput(t *testing.T) {
+	var out bytes.Buffer
+	st := &stderrTail{w: &out, holding: true}
+	st.Write([]byte("early\n"))
+	st.Write([]byte("partial"))
+	if out.Len() != 0 {
+		t.Fatalf("wrote %q before the label was set", out.String())
+	}
+	st.setLabel("child[1]: ")
+	st.Write([]byte(" line\nnext\n"))
+	const want = "child[1]: early\nchild[1]: partial line\nchild[1]: next\n"
+	if got := out.String(); got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+	if got, want := st.tail(), "early\npartial line\nnext"; got != want {
+		t.Errorf("tail = %q; want %q", got, want)
+	}
+}
+
+func TestStderrUnlabeled(t *testing.T) {
+	var out bytes.Buffer
+	st := &stderrTail{w: &out}
+	st.Write([]byte("a\nb"))
+	if got, want := out.String(), "a\nb"; got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+}
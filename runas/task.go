@@ -0,0 +1,120 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sync"
+)
+
+var (
+	tasksMu sync.Mutex
+	tasks   = map[string]func(arg []byte) ([]byte, error){}
+)
+
+// RegisterTask registers fn as the task named name, for RunNamed.
+// Like services, tasks must be registered before
+// MaybeRunChildServer. A and R must be encodable with encoding/gob.
+func RegisterTask[A, R any](name string, fn func(arg A) (R, error)) {
+	if name == "" || fn == nil {
+		panic("runas: RegisterTask needs a name and a function")
+	}
+	tasksMu.Lock()
+	defer tasksMu.Unlock()
+	if _, dup := tasks[name]; dup {
+		panic("runas: RegisterTask called twice for " + name)
+	}
+	tasks[name] = func(argGob []byte) ([]byte, error) {
+		var arg A
+		if err := gob.NewDecoder(bytes.NewReader(argGob)).Decode(&arg); err != nil {
+			return nil, fmt.Errorf("runas: decoding argument to task %q: %v", name, err)
+		}
+		reply, err := fn(arg)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(reply); err != nil {
+			return nil, fmt.Errorf("runas: encoding reply from task %q: %v", name, err)
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// RunNamed runs the task registered as name with RegisterTask in a
+// new child running as username, passing it arg and storing what it
+// returns in reply, which must be a pointer to a value of the task's
+// reply type. The child exits afterwards. It's for one-off jobs that
+// don't merit a service of their own.
+func RunNamed(username, name string, arg, reply any) error {
+	return new(Config).RunNamed(context.Background(), username, name, arg, reply)
+}
+
+// RunNamed is like the package-level RunNamed but starts the child
+// as configured by c, and gives up, killing the child, if ctx is
+// done before the task finishes.
+func (c *Config) RunNamed(ctx context.Context, username, name string, arg, reply any) error {
+	var req struct{ R taskArg }
+	req.R.Name = name
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(arg); err != nil {
+		return fmt.Errorf("runas: encoding argument to task %q: %w", name, err)
+	}
+	req.R.Arg = buf.Bytes()
+
+	cl, err := c.User(ctx, username)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	var res struct{ R taskResult }
+	if err := cl.CallContext(ctx, "InternalGoRunAs.RunTask", &req, &res); err != nil {
+		return err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(res.R.Reply)).Decode(reply); err != nil {
+		return fmt.Errorf("runas: decoding reply from task %q: %w", name, err)
+	}
+	return nil
+}
+
+type taskArg struct {
+	Name string
+	Arg  []byte // gob-encoded
+}
+
+type taskResult struct {
+	Reply []byte // gob-encoded
+}
+
+// RunTask runs a task for RunNamed.
+func (s *internalService) RunTask(arg *struct{ R taskArg }, result *struct{ R taskResult }) error {
+	tasksMu.Lock()
+	fn, ok := tasks[arg.R.Name]
+	tasksMu.Unlock()
+	if !ok {
+		return fmt.Errorf("runas: no task %q registered in child", arg.R.Name)
+	}
+	reply, err := fn(arg.R.Arg)
+	if err != nil {
+		return err
+	}
+	result.R.Reply = reply
+	return nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// newTLSKey returns a new self-signed certificate and its key, PEM
+// encoded, for one child's connection. Parent and child both present
+// it, and each accepts only it from the other, so no one without the
+// key can talk to either end.
+func newTLSKey() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		DNSNames:     []string{"runas"},
+		NotBefore:    now.Add(-time.Minute),
+		// Checked only during the handshake, right after starting.
+		NotAfter:    now.Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return buf.Bytes(), nil
+}
+
+// tlsConfig returns the TLS configuration for either end of a
+// connection keyed with pemBytes, from newTLSKey.
+func tlsConfig(pemBytes []byte) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(pemBytes, pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	pinned := cert.Certificate[0]
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		ServerName:   "runas",
+		ClientAuth:   tls.RequireAnyClientCert,
+		// The certificate is self-signed, so rather than verifying a
+		// chain, each end checks that the other has the same one.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) != 1 || !bytes.Equal(raw[0], pinned) {
+				return errors.New("runas: peer presented the wrong certificate")
+			}
+			return nil
+		},
+	}, nil
+}
+
+// startTLS generates a TLS key for the connection to cmd and passes
+// it to the child through a pipe, returning a TLS connection over
+// sock, the parent's end of the socket, and the child's end of the
+// pipe. sock is closed either way.
+func startTLS(cmd *exec.Cmd, sock *os.File) (io.ReadWriteCloser, *os.File, error) {
+	key, err := newTLSKey()
+	if err != nil {
+		sock.Close()
+		return nil, nil, fmt.Errorf("runas: failed to generate TLS key: %w", err)
+	}
+	keyr, keyw, err := os.Pipe()
+	if err != nil {
+		sock.Close()
+		return nil, nil, fmt.Errorf("runas: failed to create TLS key pipe: %w", err)
+	}
+	// It fits in the pipe's buffer, so this doesn't wait for the
+	// child.
+	_, err = keyw.Write(key)
+	keyw.Close()
+	if err == nil {
+		var conn io.ReadWriteCloser
+		if conn, err = tlsConn(sock, key, false); err == nil {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, keyr)
+			fd := 2 + len(cmd.ExtraFiles)
+			cmd.Env = append(cmd.Env, "BECOME_GO_RUNAS_TLS="+strconv.Itoa(fd))
+			return conn, keyr, nil
+		}
+	} else {
+		sock.Close()
+	}
+	keyr.Close()
+	return nil, nil, fmt.Errorf("runas: failed to set up TLS: %w", err)
+}
+
+// childTLS wraps the child's socket in TLS, with the key read from
+// the pipe the parent passed as descriptor keyFd.
+func childTLS(sock *os.File, keyFd string) (io.ReadWriteCloser, error) {
+	fd, err := strconv.Atoi(keyFd)
+	if err != nil {
+		return nil, fmt.Errorf("runas: bad BECOME_GO_RUNAS_TLS %q", keyFd)
+	}
+	keyr := os.NewFile(uintptr(fd), "runas-tls-key")
+	key, err := io.ReadAll(keyr)
+	keyr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("runas: reading TLS key: %w", err)
+	}
+	conn, err := tlsConn(sock, key, true)
+	if err != nil {
+		return nil, fmt.Errorf("runas: setting up TLS: %w", err)
+	}
+	return conn, nil
+}
+
+// tlsConn wraps the socket f in TLS, as the client or server end.
+// f is closed either way.
+func tlsConn(f *os.File, pemBytes []byte, server bool) (io.ReadWriteCloser, error) {
+	defer f.Close()
+	conf, err := tlsConfig(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	if server {
+		return tls.Server(nc, conf), nil
+	}
+	return tls.Client(nc, conf), nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// A Transport is a way of connecting a parent to its child, for
+// Config.Transport. It has a parent's side, used before the child
+// starts, and a child's side, used by ServeChild. Since the child
+// can't be handed the parent's Transport, each is registered by
+// name, in parent and child alike, and the parent tells the child
+// the name through its environment.
+type Transport interface {
+	// Connect arranges for cmd, not yet started, to be connected
+	// to the parent, returning the parent's end and the child's
+	// ends, which the parent closes once the child has started.
+	// Anything else the child needs goes in cmd.ExtraFiles and
+	// cmd.Env, which Connect may only append to.
+	Connect(cmd *exec.Cmd) (conn io.ReadWriteCloser, childEnds []*os.File, err error)
+
+	// Accept returns, in the child, its end of the connection.
+	Accept() (io.ReadWriteCloser, error)
+}
+
+// Names of the built-in transports, for Config.Transport.
+const (
+	PipeTransport   = "pipe"   // the child's stdin and stdout; the default
+	SocketTransport = "socket" // a socketpair; see Config.Socket
+	TLSTransport    = "tls"    // TLS over a socketpair; see Config.TLS
+)
+
+var (
+	transportsMu sync.Mutex
+	transports   = map[string]Transport{
+		PipeTransport:   pipeTransport{},
+		SocketTransport: socketTransport{},
+		TLSTransport:    socketTransport{tls: true},
+	}
+)
+
+// RegisterTransport registers t as the transport named name, for
+// children started with Config.Transport set to name. Like
+// services, transports must be registered before
+// MaybeRunChildServer, since the child accepts with its own
+// registration.
+func RegisterTransport(name string, t Transport) {
+	if name == "" || t == nil {
+		panic("runas: RegisterTransport needs a name and a transport")
+	}
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if _, dup := transports[name]; dup {
+		panic("runas: RegisterTransport called twice for " + name)
+	}
+	transports[name] = t
+}
+
+func lookupTransport(name string) (Transport, error) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	t, ok := transports[name]
+	if !ok {
+		return nil, fmt.Errorf("runas: no transport registered as %q", name)
+	}
+	return t, nil
+}
+
+// transportName returns the name of the transport c asks for.
+func (c *Config) transportName() (string, error) {
+	switch {
+	case c.Transport != "" && (c.Socket || c.TLS):
+		return "", errors.New("runas: Config.Transport can't be used with Config.Socket or Config.TLS")
+	case c.TLS && !c.Socket:
+		return "", errors.New("runas: Config.TLS needs Config.Socket")
+	case c.TLS:
+		return TLSTransport, nil
+	case c.Socket:
+		return SocketTransport, nil
+	case c.Transport != "":
+		return c.Transport, nil
+	}
+	return PipeTransport, nil
+}
+
+// transport returns the transport c asks for and its name, and
+// arranges for cmd to accept with it.
+func (c *Config) transport(cmd *exec.Cmd) (string, Transport, error) {
+	name, err := c.transportName()
+	if err != nil {
+		return "", nil, err
+	}
+	t, err := lookupTransport(name)
+	if err != nil {
+		return "", nil, err
+	}
+	cmd.Env = append(cmd.Env, "BECOME_GO_RUNAS_TRANSPORT="+name)
+	return name, t, nil
+}
+
+// childTransport returns, in the child, the transport its parent
+// chose.
+func childTransport() (Transport, error) {
+	name := os.Getenv("BECOME_GO_RUNAS_TRANSPORT")
+	if name == "" {
+		name = PipeTransport
+	}
+	return lookupTransport(name)
+}
+
+// pipeTransport is PipeTransport: it connects over the child's
+// stdin and stdout.
+type pipeTransport struct{}
+
+func (pipeTransport) Connect(cmd *exec.Cmd) (io.ReadWriteCloser, []*os.File, error) {
+	// Use our own pipes rather than cmd.StdoutPipe and friends so
+	// that the parent's ends stay open until the Client is closed,
+	// regardless of when cmd.Wait returns.
+	childIn, stdin, err := os.Pipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("runas: failed to create child stdin pipe: %w", err)
+	}
+	stdout, childOut, err := os.Pipe()
+	if err != nil {
+		childIn.Close()
+		stdin.Close()
+		return nil, nil, fmt.Errorf("runas: failed to create child stdout pipe: %w", err)
+	}
+	cmd.Stdin = childIn
+	cmd.Stdout = childOut
+	return &splitReadWrite{stdout, stdin}, []*os.File{childIn, childOut}, nil
+}
+
+func (pipeTransport) Accept() (io.ReadWriteCloser, error) {
+	return &splitReadWrite{os.Stdin, os.Stdout}, nil
+}
+
+// socketTransport is SocketTransport, or TLSTransport if tls is
+// set: it connects over a socketpair, wrapped in TLS if asked.
+type socketTransport struct {
+	tls bool
+}
+
+func (t socketTransport) Connect(cmd *exec.Cmd) (io.ReadWriteCloser, []*os.File, error) {
+	mine, theirs, err := socketpair()
+	if err != nil {
+		return nil, nil, fmt.Errorf("runas: failed to create child socket: %w", err)
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, theirs)
+	// ExtraFiles start after stderr.
+	fd := 2 + len(cmd.ExtraFiles)
+	cmd.Env = append(cmd.Env, "BECOME_GO_RUNAS_SOCKET="+strconv.Itoa(fd))
+	if !t.tls {
+		// As a net.Conn, for CloseWrite; see Client.Shutdown.
+		conn, err := net.FileConn(mine)
+		mine.Close()
+		if err != nil {
+			theirs.Close()
+			return nil, nil, fmt.Errorf("runas: failed to create child socket: %w", err)
+		}
+		return conn, []*os.File{theirs}, nil
+	}
+	conn, keyr, err := startTLS(cmd, mine)
+	if err != nil {
+		theirs.Close()
+		return nil, nil, err
+	}
+	return conn, []*os.File{theirs, keyr}, nil
+}
+
+func (t socketTransport) Accept() (io.ReadWriteCloser, error) {
+	v := os.Getenv("BECOME_GO_RUNAS_SOCKET")
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("runas: bad BECOME_GO_RUNAS_SOCKET %q", v)
+	}
+	sock := os.NewFile(uintptr(fd), "runas-socket")
+	if !t.tls {
+		return sock, nil
+	}
+	return childTLS(sock, os.Getenv("BECOME_GO_RUNAS_TLS"))
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runas
+
+import (
+	"bufio"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long failed lookups are cached for, at most, so that a
+// missing user doesn't hammer a directory service but appears soon
+// once added.
+const userCacheFailTTL = time.Second
+
+var userCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]userCacheEntry
+}
+
+type userCacheEntry struct {
+	arg     *internalDropArg
+	u       *user.User
+	err     error
+	expires time.Time
+}
+
+// SetUserCacheTTL makes User, UserGroup and Pool.Get cache the
+// results of looking up a username, including its groups, for ttl,
+// which saves going to the passwd database (or NSS, or LDAP) every
+// time. Failed lookups are cached for no more than a second. A ttl
+// of zero, the default, turns the cache off and flushes it.
+func SetUserCacheTTL(ttl time.Duration) {
+	userCache.mu.Lock()
+	defer userCache.mu.Unlock()
+	userCache.ttl = ttl
+	if ttl <= 0 {
+		userCache.entries = nil
+	}
+}
+
+// FlushUserCache forgets every lookup cached because of
+// SetUserCacheTTL, so that changes to users and groups take effect
+// at once.
+func FlushUserCache() {
+	userCache.mu.Lock()
+	defer userCache.mu.Unlock()
+	userCache.entries = nil
+}
+
+// lookupUser returns how to drop privileges to username.
+func lookupUser(username string) (*internalDropArg, *user.User, error) {
+	userCache.mu.Lock()
+	ttl := userCache.ttl
+	e, ok := userCache.entries[username]
+	userCache.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.result()
+	}
+
+	e = userCacheEntry{}
+	e.u, e.err = user.Lookup(username)
+	if e.err != nil {
+		e.err = userLookupError(username, e.err)
+	} else {
+		e.arg, e.err = userDropArg(e.u)
+	}
+	if ttl > 0 {
+		if e.err != nil {
+			ttl = min(ttl, userCacheFailTTL)
+		}
+		e.expires = time.Now().Add(ttl)
+		userCache.mu.Lock()
+		if userCache.entries == nil {
+			userCache.entries = make(map[string]userCacheEntry)
+		}
+		userCache.entries[username] = e
+		userCache.mu.Unlock()
+	}
+	return e.result()
+}
+
+// result returns copies of e's results, which its callers modify.
+func (e userCacheEntry) result() (*internalDropArg, *user.User, error) {
+	if e.err != nil {
+		return nil, nil, e.err
+	}
+	arg := *e.arg
+	arg.Groups = slices.Clone(arg.Groups)
+	u := *e.u
+	return &arg, &u, nil
+}
+
+// loginShell returns the login shell in u's passwd entry, or "" if
+// it has none. os/user doesn't report it, so it comes from
+// /etc/passwd, which misses users only NSS knows about.
+func loginShell(u *user.User) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(s.Text(), ":")
+		if len(fields) == 7 && fields[0] == u.Username && fields[2] == u.Uid {
+			return fields[6]
+		}
+	}
+	return ""
+}
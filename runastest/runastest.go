@@ -0,0 +1,57 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package runastest helps test code that uses package runas without
+// being root: it serves RPC services in the test's own process, with
+// no child process and no dropping of privileges.
+package runastest
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+
+	"github.com/bradfitz/go-runas/runas"
+)
+
+// NewTestClient returns a client connected over an in-memory pipe to
+// a server running in the calling process. The server has services
+// registered, as by rpc.Server.Register, or if there are none, it's
+// runas.Server. It panics if a service can't be registered.
+//
+// Methods run as the calling user, with nothing dropped, and unlike
+// in a child, a method that panics takes the test binary with it.
+// Close the client to stop the server.
+func NewTestClient(services ...any) *rpc.Client {
+	server := runas.Server
+	if len(services) > 0 {
+		server = rpc.NewServer()
+		for _, svc := range services {
+			if err := server.Register(svc); err != nil {
+				panic(fmt.Sprintf("runastest: %v", err))
+			}
+		}
+	}
+	return NewServerClient(server)
+}
+
+// NewServerClient is like NewTestClient but serves server, which may
+// be one created by runas.NewServer.
+func NewServerClient(server *rpc.Server) *rpc.Client {
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	return rpc.NewClient(clientConn)
+}